@@ -0,0 +1,119 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/oscaro/pipe2mattermost/p2m"
+)
+
+// codeFlag is a boolean flag that optionally takes a language hint, as in
+// -code or -code=json.
+type codeFlag struct {
+	opts *p2m.FollowOptions
+}
+
+func (f codeFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (f codeFlag) String() string {
+	if f.opts == nil || !f.opts.Code {
+		return ""
+	}
+	return f.opts.CodeLang
+}
+
+func (f codeFlag) Set(s string) error {
+	switch s {
+	case "false":
+		f.opts.Code = false
+	case "true":
+		f.opts.Code = true
+		f.opts.CodeLang = ""
+	default:
+		f.opts.Code = true
+		f.opts.CodeLang = s
+	}
+	return nil
+}
+
+// regexpsFlag is a flag that can be repeated to give multiple regexps.
+type regexpsFlag struct {
+	res *[]*regexp.Regexp
+}
+
+func (f regexpsFlag) String() string {
+	if f.res == nil {
+		return ""
+	}
+
+	var exprs []string
+	for _, re := range *f.res {
+		exprs = append(exprs, re.String())
+	}
+	return strings.Join(exprs, ", ")
+}
+
+func (f regexpsFlag) Set(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	*f.res = append(*f.res, re)
+	return nil
+}
+
+// mentionsFlag is a flag that can be repeated to give multiple mention rules.
+type mentionsFlag struct {
+	rules *[]p2m.MentionRule
+}
+
+func (f mentionsFlag) String() string {
+	if f.rules == nil {
+		return ""
+	}
+
+	var rules []string
+	for _, rule := range *f.rules {
+		rules = append(rules, rule.Pattern.String()+"="+strings.Join(rule.Mentions, ","))
+	}
+	return strings.Join(rules, " ")
+}
+
+func (f mentionsFlag) Set(s string) error {
+	rule, err := p2m.ParseMentionRule(s)
+	if err != nil {
+		return err
+	}
+	*f.rules = append(*f.rules, rule)
+	return nil
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// stringsFlag is a flag that can be repeated to give multiple values.
+type stringsFlag struct {
+	values *[]string
+}
+
+func (f stringsFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return strings.Join(*f.values, ", ")
+}
+
+func (f stringsFlag) Set(s string) error {
+	*f.values = append(*f.values, s)
+	return nil
+}
@@ -0,0 +1,208 @@
+package p2m
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// ANSIMode tells what to do with the ANSI escape sequences of the input.
+type ANSIMode int
+
+const (
+	// KeepANSI leaves escape sequences untouched
+	KeepANSI ANSIMode = iota
+	// StripANSI removes all escape sequences
+	StripANSI
+	// MarkdownANSI translates bold, underlined and colored text to markdown
+	// and emojis, and removes the other escape sequences
+	MarkdownANSI
+)
+
+// Emojis prepended to text colored in red, green and yellow.
+var ansiColorEmojis = map[int]string{
+	31: ":red_circle:",
+	32: ":white_check_mark:",
+	33: ":warning:",
+}
+
+type ansiStyle struct {
+	bold      bool
+	underline bool
+	// color is 0 or a key of ansiColorEmojis
+	color int
+}
+
+// ansiSpan is a piece of text in a given style.
+type ansiSpan struct {
+	text  string
+	style ansiStyle
+}
+
+// processANSI applies mode to the escape sequences of s.
+func processANSI(s string, mode ANSIMode) string {
+	if mode == KeepANSI || !strings.ContainsAny(s, "\x1b\x07") {
+		return s
+	}
+
+	spans := parseANSI(s)
+
+	var buf bytes.Buffer
+	var color int
+
+	for _, span := range spans {
+		if mode == StripANSI {
+			buf.WriteString(span.text)
+			continue
+		}
+
+		core := strings.TrimSpace(span.text)
+		if core == "" {
+			buf.WriteString(span.text)
+			continue
+		}
+
+		lead := span.text[:strings.Index(span.text, core)]
+		trail := span.text[len(lead)+len(core):]
+
+		// markdown delimiters must be next to the text
+		var delim string
+		if span.style.bold {
+			delim += "**"
+		}
+		if span.style.underline {
+			delim += "_"
+		}
+
+		buf.WriteString(lead)
+		if span.style.color != color && span.style.color != 0 {
+			buf.WriteString(ansiColorEmojis[span.style.color] + " ")
+		}
+		buf.WriteString(delim + core + reverse(delim) + trail)
+
+		color = span.style.color
+	}
+
+	return buf.String()
+}
+
+// parseANSI splits s in spans of text in the same style, dropping the escape
+// sequences.
+func parseANSI(s string) []ansiSpan {
+	var spans []ansiSpan
+	var style ansiStyle
+	var text bytes.Buffer
+
+	flush := func() {
+		if text.Len() > 0 {
+			spans = append(spans, ansiSpan{text.String(), style})
+			text.Reset()
+		}
+	}
+
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == '\x07':
+			i++
+
+		case s[i] == '\x1b' && i+1 < len(s) && s[i+1] == '[':
+			params, final, n := parseCSI(s[i+2:])
+			i += 2 + n
+			if final == 'm' {
+				flush()
+				style = style.apply(params)
+			}
+
+		case s[i] == '\x1b' && i+1 < len(s) && s[i+1] == ']':
+			// OSC, terminated by BEL or ST
+			end := strings.IndexByte(s[i:], '\x07')
+			if st := strings.Index(s[i:], "\x1b\\"); st >= 0 && (end < 0 || st < end) {
+				end = st + 1
+			}
+			if end < 0 {
+				i = len(s)
+			} else {
+				i += end + 1
+			}
+
+		case s[i] == '\x1b':
+			// other sequences: ESC, intermediate bytes and a final byte
+			i++
+			for i < len(s) && s[i] >= 0x20 && s[i] <= 0x2f {
+				i++
+			}
+			if i < len(s) {
+				i++
+			}
+
+		default:
+			text.WriteByte(s[i])
+			i++
+		}
+	}
+	flush()
+
+	return spans
+}
+
+// parseCSI parses the parameters and final byte of the control sequence s
+// starts with, and returns them along with its length.
+func parseCSI(s string) (string, byte, int) {
+	i := 0
+	for i < len(s) && s[i] >= 0x20 && s[i] <= 0x3f {
+		i++
+	}
+	if i == len(s) {
+		return "", 0, i
+	}
+	return s[:i], s[i], i + 1
+}
+
+// apply returns the style resulting from the SGR parameters params.
+func (st ansiStyle) apply(params string) ansiStyle {
+	codes := strings.Split(params, ";")
+
+	for i := 0; i < len(codes); i++ {
+		code, err := strconv.Atoi(codes[i])
+		if err != nil && codes[i] != "" {
+			continue
+		}
+
+		switch {
+		case code == 0:
+			st = ansiStyle{}
+		case code == 1:
+			st.bold = true
+		case code == 22:
+			st.bold = false
+		case code == 4:
+			st.underline = true
+		case code == 24:
+			st.underline = false
+		case code >= 30 && code <= 37, code >= 90 && code <= 97:
+			st.color = code % 60
+			if _, ok := ansiColorEmojis[st.color]; !ok {
+				st.color = 0
+			}
+		case code == 39:
+			st.color = 0
+		case code == 38, code == 48:
+			// extended colors: 38;5;n or 38;2;r;g;b
+			if i+1 < len(codes) && codes[i+1] == "5" {
+				i += 2
+			} else if i+1 < len(codes) && codes[i+1] == "2" {
+				i += 4
+			}
+		}
+	}
+
+	return st
+}
+
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
@@ -0,0 +1,31 @@
+package p2m
+
+import "testing"
+
+func TestProcessANSI(t *testing.T) {
+	tests := []struct {
+		s    string
+		mode ANSIMode
+		want string
+	}{
+		{"\x1b[31mred\x1b[0m", KeepANSI, "\x1b[31mred\x1b[0m"},
+		{"plain", StripANSI, "plain"},
+		{"\x1b[1;31mFAIL\x1b[0m: test", StripANSI, "FAIL: test"},
+		{"\x1b[2K\x1b[1Gdone", StripANSI, "done"},
+		{"\x1b]0;title\x07text", StripANSI, "text"},
+		{"\x1b]8;;http://x\x1b\\link\x1b]8;;\x1b\\", StripANSI, "link"},
+		{"\x1b(Btext\x07", StripANSI, "text"},
+		{"\x1b[1mbold\x1b[0m text", MarkdownANSI, "**bold** text"},
+		{"\x1b[4m under \x1b[0m", MarkdownANSI, " _under_ "},
+		{"\x1b[32mok\x1b[0m and \x1b[31mfailed\x1b[0m", MarkdownANSI,
+			":white_check_mark: ok and :red_circle: failed"},
+		{"\x1b[1;33mwarn\x1b[0m", MarkdownANSI, ":warning: **warn**"},
+		{"\x1b[35mmagenta\x1b[0m", MarkdownANSI, "magenta"},
+	}
+
+	for _, test := range tests {
+		if got := processANSI(test.s, test.mode); got != test.want {
+			t.Errorf("processANSI(%q, %d) = %q, want %q", test.s, test.mode, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package p2m
+
+import "unicode/utf8"
+
+// batch gathers lines that are sent together as a single post.
+type batch struct {
+	lines []string
+	runes int
+
+	maxLines int
+	maxRunes int
+}
+
+func (b *batch) empty() bool {
+	return len(b.lines) == 0
+}
+
+// fits reports if line can be added without exceeding the size limit. A line
+// always fits in an empty batch.
+func (b *batch) fits(line string) bool {
+	return b.empty() || b.runes+1+utf8.RuneCountInString(line) <= b.maxRunes
+}
+
+func (b *batch) full() bool {
+	return b.maxLines > 0 && len(b.lines) >= b.maxLines
+}
+
+func (b *batch) add(line string) {
+	if !b.empty() {
+		b.runes++
+	}
+	b.runes += utf8.RuneCountInString(line)
+	b.lines = append(b.lines, line)
+}
+
+// takeLines returns the batch's lines and empties it.
+func (b *batch) takeLines() []string {
+	lines := b.lines
+	b.lines = nil
+	b.runes = 0
+	return lines
+}
@@ -1,11 +1,11 @@
 package p2m
 
 import (
-	"bufio"
 	"errors"
-	"io"
+	"net/http"
 	"os/user"
 	"path/filepath"
+	"time"
 
 	"github.com/dickeyxxx/netrc"
 	"github.com/mattermost/platform/model"
@@ -15,12 +15,34 @@ type Client struct {
 	m *model.Client4
 
 	self *model.User
+
+	limiter *rateLimiter
+	retry   RetryPolicy
 }
 
 func MakeClient(serverURL string) *Client {
-	return &Client{
-		m: model.NewAPIv4Client(serverURL),
+	c := &Client{
+		m:       model.NewAPIv4Client(serverURL),
+		limiter: &rateLimiter{},
+	}
+	c.m.HttpClient.Timeout = maxAttemptDuration
+	return c
+}
+
+// SetRateLimit limits the number of posts and updates sent per second, with
+// bursts of up to burst ones. A rate of 0 disables the limit.
+func (c *Client) SetRateLimit(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
 	}
+
+	c.limiter.mu.Lock()
+	defer c.limiter.mu.Unlock()
+
+	c.limiter.rate = rate
+	c.limiter.burst = float64(burst)
+	c.limiter.tokens = float64(burst)
+	c.limiter.last = time.Now()
 }
 
 func (c *Client) Login() error {
@@ -75,34 +97,210 @@ func (c *Client) GetChannelId(name, teamName string) (string, error) {
 	return ch.Id, nil
 }
 
+// Post posts msg in the given channel, splitting it in multiple posts if
+// it's too long. It returns the id of the last one.
 func (c *Client) Post(msg, channelId string) (string, error) {
-	draft := model.Post{
-		UserId:    c.self.Id,
+	var postId string
+
+	for _, chunk := range splitMessage(msg, model.POST_MESSAGE_MAX_RUNES) {
+		var err error
+
+		postId, err = c.createPost(&model.Post{
+			ChannelId: channelId,
+			Message:   chunk,
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return postId, nil
+}
+
+// Reply posts msg as a reply to the given root post, splitting it like Post.
+// If rootId is empty the first post becomes the root of the following ones.
+// It returns the ids of the root and last posts.
+func (c *Client) Reply(msg, channelId, rootId string) (string, string, error) {
+	var postId string
+
+	for _, chunk := range splitMessage(msg, model.POST_MESSAGE_MAX_RUNES) {
+		var err error
+
+		postId, err = c.createPost(&model.Post{
+			ChannelId: channelId,
+			RootId:    rootId,
+			Message:   chunk,
+		})
+		if err != nil {
+			return "", "", err
+		}
+
+		if rootId == "" {
+			rootId = postId
+		}
+	}
+
+	return rootId, postId, nil
+}
+
+// PostAttachment posts a in the given channel with msg as the message, as a
+// reply to rootId if it's not empty. Its text is split in multiple posts if
+// it's too long, msg being only part of the first one. It returns the id of
+// the first post.
+func (c *Client) PostAttachment(msg string, a *model.SlackAttachment, channelId, rootId string) (string, error) {
+	var firstId string
+
+	for _, chunk := range splitMessage(a.Text, model.POST_MESSAGE_MAX_RUNES) {
+		part := *a
+		part.Text = chunk
+		part.Fallback = chunk
+
+		postId, err := c.createPost(&model.Post{
+			ChannelId: channelId,
+			RootId:    rootId,
+			Message:   msg,
+			Props: model.StringInterface{
+				"attachments": []*model.SlackAttachment{&part},
+			},
+		})
+		if err != nil {
+			return "", err
+		}
+
+		if firstId == "" {
+			firstId = postId
+		}
+		msg = ""
+	}
+
+	return firstId, nil
+}
+
+// PostFile posts msg in the given channel with data attached to it as a file.
+// The post is a reply to rootId if it's not empty.
+func (c *Client) PostFile(msg, channelId, rootId, filename string, data []byte) (string, error) {
+	var upload *model.FileUploadResponse
+
+	err := c.do(func() (resp *model.Response) {
+		upload, resp = c.m.UploadFile(data, channelId, filename)
+		return
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var fileIds []string
+	for _, info := range upload.FileInfos {
+		fileIds = append(fileIds, info.Id)
+	}
+
+	return c.createPost(&model.Post{
 		ChannelId: channelId,
+		RootId:    rootId,
 		Message:   msg,
-	}
+		FileIds:   fileIds,
+	})
+}
 
-	p, resp := c.m.CreatePost(&draft)
-	if p == nil {
-		return "", resp.Error
+func (c *Client) createPost(draft *model.Post) (string, error) {
+	draft.UserId = c.self.Id
+
+	var p *model.Post
+
+	err := c.do(func() (resp *model.Response) {
+		p, resp = c.m.CreatePost(draft)
+		return
+	})
+	if err != nil {
+		return "", err
 	}
 
 	return p.Id, nil
 }
 
+// do calls the API through fn, waiting as needed to respect the rate limit
+// and the server's throttling, and retrying it according to the retry
+// policy.
+func (c *Client) do(fn func() *model.Response) error {
+	start := time.Now()
+	failures := 0
+
+	for {
+		c.limiter.wait()
+
+		resp := fn()
+		c.limiter.observe(resp)
+
+		if resp.Error == nil {
+			return nil
+		}
+
+		var delay time.Duration
+		if resp.StatusCode != http.StatusTooManyRequests {
+			failures++
+			delay = c.retry.backoff(failures)
+		}
+
+		if !c.retry.allows(resp, failures, time.Since(start)+delay) {
+			if resp.StatusCode == http.StatusTooManyRequests || retryable(resp) {
+				return transientError{resp.Error}
+			}
+			return resp.Error
+		}
+		time.Sleep(delay)
+	}
+}
+
+// throttled returns how long to wait before the next post or update can be
+// sent.
+func (c *Client) throttled() time.Duration {
+	return c.limiter.delay()
+}
+
+// Update replaces the message of the given post. Only the end of msg is kept
+// if it's too long.
 func (c *Client) Update(postId, msg string) (string, error) {
+	msg = tailMessage(msg, model.POST_MESSAGE_MAX_RUNES)
 	draft := model.PostPatch{
 		Message: &msg,
 	}
 
-	p, resp := c.m.PatchPost(postId, &draft)
-	if p == nil {
-		return "", resp.Error
+	var p *model.Post
+
+	err := c.do(func() (resp *model.Response) {
+		p, resp = c.m.PatchPost(postId, &draft)
+		return
+	})
+	if err != nil {
+		return "", err
 	}
 
 	return p.Id, nil
 }
 
+// Append appends text to the message of the given post.
+func (c *Client) Append(postId, text string) error {
+	var p *model.Post
+
+	err := c.do(func() (resp *model.Response) {
+		p, resp = c.m.GetPost(postId, "")
+		return
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Update(postId, p.Message+text)
+	return err
+}
+
+// SetRetryPolicy sets how posts and updates that failed because of a
+// transient error are retried.
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.retry = p
+	c.m.HttpClient.Timeout = p.attemptTimeout()
+}
+
 func getUserCredentials() (string, string, error) {
 	usr, err := user.Current()
 	if err != nil {
@@ -117,27 +315,3 @@ func getUserCredentials() (string, string, error) {
 
 	return credentials.Get("login"), credentials.Get("password"), nil
 }
-
-func (c *Client) Follow(r io.Reader, channelId string, update bool) error {
-	scanner := bufio.NewScanner(r)
-
-	var postId string
-
-	doPost := func(msg string) (err error) {
-		if update && postId != "" {
-			postId, err = c.Update(postId, msg)
-		} else {
-			postId, err = c.Post(msg, channelId)
-		}
-		return
-	}
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if err := doPost(line); err != nil {
-			return err
-		}
-	}
-
-	return scanner.Err()
-}
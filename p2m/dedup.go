@@ -0,0 +1,68 @@
+package p2m
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var (
+	uuidRegexp   = regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`)
+	numberRegexp = regexp.MustCompile(`\d+`)
+)
+
+// dedup collapses consecutive identical lines, like syslog.
+type dedup struct {
+	// normalize makes lines that only differ by their numbers and UUIDs
+	// identical
+	normalize bool
+
+	key     string
+	started bool
+	// number of times the last line was repeated, and its last repetition
+	repeats int
+	last    input
+}
+
+// add reports if in must be posted, along with the summary of the repetitions
+// of the previous line that it ends, if any: its text is empty otherwise.
+func (d *dedup) add(in input) (input, bool) {
+	key := in.text
+	if d.normalize {
+		key = normalizeLine(in.text)
+	}
+
+	if d.started && key == d.key {
+		d.repeats++
+		d.last = in
+		return input{}, false
+	}
+
+	summary := d.take()
+	d.key = key
+	d.started = true
+
+	return summary, true
+}
+
+// take returns the summary of the repetitions of the last line, if any, and
+// starts counting them again. It has the number and time of the last
+// repetition.
+func (d *dedup) take() input {
+	if d.repeats == 0 {
+		return input{}
+	}
+
+	summary := d.last
+	summary.text = "last message repeated 1 time"
+	if d.repeats > 1 {
+		summary.text = fmt.Sprintf("last message repeated %d times", d.repeats)
+	}
+	d.repeats = 0
+	return summary
+}
+
+// normalizeLine replaces the UUIDs and numbers of line with placeholders.
+func normalizeLine(line string) string {
+	line = uuidRegexp.ReplaceAllString(line, "<uuid>")
+	return numberRegexp.ReplaceAllString(line, "<n>")
+}
@@ -0,0 +1,70 @@
+package p2m
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDedup(t *testing.T) {
+	tests := []struct {
+		normalize bool
+		lines     []string
+		want      []string
+	}{
+		{false, []string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{
+			false,
+			[]string{"a", "a", "b", "b", "b", "a"},
+			[]string{"a", "last message repeated 1 time", "b", "last message repeated 2 times", "a"},
+		},
+		{
+			false,
+			[]string{"x", "x", "x"},
+			[]string{"x", "last message repeated 2 times"},
+		},
+		{
+			false,
+			[]string{"took 12ms", "took 15ms"},
+			[]string{"took 12ms", "took 15ms"},
+		},
+		{
+			true,
+			[]string{"took 12ms", "took 15ms", "job 3f2b1c9e-7d4a-4e5b-9c1d-2a3b4c5d6e7f done", "job 0a1b2c3d-4e5f-6a7b-8c9d-0e1f2a3b4c5d done"},
+			[]string{"took 12ms", "last message repeated 1 time", "job 3f2b1c9e-7d4a-4e5b-9c1d-2a3b4c5d6e7f done", "last message repeated 1 time"},
+		},
+	}
+
+	for _, test := range tests {
+		d := &dedup{normalize: test.normalize}
+
+		var got []string
+		for i, line := range test.lines {
+			summary, ok := d.add(input{text: line, num: i + 1})
+			if summary.text != "" {
+				got = append(got, summary.text)
+			}
+			if ok {
+				got = append(got, line)
+			}
+		}
+		if summary := d.take(); summary.text != "" {
+			got = append(got, summary.text)
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("dedup(%q) = %q, want %q", test.lines, got, test.want)
+		}
+	}
+}
+
+func TestDedupSummaryLine(t *testing.T) {
+	d := &dedup{}
+	for i := 1; i <= 3; i++ {
+		d.add(input{text: "a", num: i})
+	}
+
+	// the summary has the number of the last repetition
+	if summary := d.take(); summary.num != 3 {
+		t.Errorf("summary of lines 1-3 has number %d, want 3", summary.num)
+	}
+}
@@ -0,0 +1,124 @@
+package p2m
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattermost/platform/model"
+)
+
+// InputFormat is the format of the lines read.
+type InputFormat int
+
+const (
+	// PlainFormat lines are posted as they are
+	PlainFormat InputFormat = iota
+	// JSONFormat lines are JSON objects posted as attachments
+	JSONFormat
+	// CSVFormat, TSVFormat and ColumnsFormat lines are the rows of a table,
+	// with columns separated by commas, tabs, or aligned with spaces. The
+	// first line is the header.
+	CSVFormat
+	TSVFormat
+	ColumnsFormat
+)
+
+// Values of the level field of JSON objects, lowercased.
+var levelNames = map[string]Level{
+	"emerg":     ErrorLevel,
+	"emergency": ErrorLevel,
+	"alert":     ErrorLevel,
+	"crit":      ErrorLevel,
+	"critical":  ErrorLevel,
+	"fatal":     ErrorLevel,
+	"panic":     ErrorLevel,
+	"err":       ErrorLevel,
+	"error":     ErrorLevel,
+	"warn":      WarningLevel,
+	"warning":   WarningLevel,
+}
+
+// Field values shorter than this are shown side by side.
+const shortFieldRunes = 40
+
+// parseEntry parses line as a JSON object and returns its attachment, or false
+// if it isn't one.
+func parseEntry(line string, opts FollowOptions) (*model.SlackAttachment, bool) {
+	var obj map[string]interface{}
+
+	d := json.NewDecoder(strings.NewReader(line))
+	d.UseNumber()
+	if err := d.Decode(&obj); err != nil || obj == nil || d.More() {
+		return nil, false
+	}
+
+	a := &model.SlackAttachment{}
+
+	for _, key := range opts.MessageKeys {
+		if v, ok := obj[key]; ok {
+			a.Text = formatValue(v)
+			break
+		}
+	}
+	if a.Text == "" {
+		a.Text = line
+	}
+	a.Fallback = a.Text
+
+	if v, ok := obj[opts.LevelKey]; ok {
+		a.Color = levelColors[parseLevel(v)]
+	}
+
+	for _, key := range opts.FieldKeys {
+		v, ok := obj[key]
+		if !ok {
+			continue
+		}
+
+		value := formatValue(v)
+		a.Fields = append(a.Fields, &model.SlackAttachmentField{
+			Title: key,
+			Value: value,
+			Short: utf8.RuneCountInString(value) < shortFieldRunes,
+		})
+	}
+
+	return a, true
+}
+
+// parseLevel returns the level described by v: a name or a number as used by
+// bunyan and pino.
+func parseLevel(v interface{}) Level {
+	switch v := v.(type) {
+	case string:
+		return levelNames[strings.ToLower(v)]
+	case json.Number:
+		n, err := v.Int64()
+		switch {
+		case err != nil:
+		case n >= 50:
+			return ErrorLevel
+		case n >= 40:
+			return WarningLevel
+		}
+	}
+	return InfoLevel
+}
+
+// formatValue returns v as text: strings as they are, other values as JSON.
+func formatValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return fmt.Sprint(v)
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
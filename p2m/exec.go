@@ -0,0 +1,482 @@
+package p2m
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReportPolicy tells when the output of a command is posted.
+type ReportPolicy int
+
+const (
+	// ReportAlways posts the output while the command runs
+	ReportAlways ReportPolicy = iota
+	// ReportOutput posts the output once the command exits, if it failed or
+	// wrote something
+	ReportOutput
+	// ReportFailure posts the output once the command exits, if it failed
+	ReportFailure
+)
+
+// ErrSkipped is returned by Run when the command wasn't run because its lock
+// file is held by another process.
+var ErrSkipped = errors.New("Skipped: the lock file is held by another process")
+
+var errLocked = errors.New("locked")
+
+const (
+	// exit code of commands that timed out, as with GNU timeout
+	timeoutExitCode = 124
+
+	// number of lines of output included in timeout notices
+	runTailLines = 20
+
+	// bytes kept from the beginning and from the end of the output of
+	// commands reported once they exit
+	reportedOutputHead = 512 * 1024
+	reportedOutputTail = 512 * 1024
+)
+
+type RunOptions struct {
+	Follow FollowOptions
+
+	// StderrPrefix is prepended to the lines the command writes on its
+	// standard error.
+	StderrPrefix string
+
+	Report ReportPolicy
+
+	// If LockFile is set the command is only run if no other process holds
+	// a lock on it, so that runs of the same job don't overlap.
+	LockFile string
+
+	// If Timeout is set the command is asked to terminate when it runs for
+	// longer than that, then killed if it's still running after KillGrace.
+	// Its exit code is then 124.
+	Timeout   time.Duration
+	KillGrace time.Duration
+}
+
+// Run runs the command described by argv, posting its output in the given
+// channel and then a summary of its execution, according to the report
+// policy. It returns the command's exit code.
+func (c *Client) Run(ctx context.Context, channelId string, argv []string, opts RunOptions) (int, error) {
+	f := c.newFollower(channelId, opts.Follow)
+
+	if opts.LockFile != "" {
+		unlock, err := lockFile(opts.LockFile)
+		if err == errLocked {
+			host, _ := os.Hostname()
+			msg := fmt.Sprintf(":fast_forward: Skipped on `%s`: `%s`, its previous run is still in progress",
+				host, commandLine(argv))
+			if err := f.notice(msg); err != nil {
+				return -1, err
+			}
+			return -1, ErrSkipped
+		}
+		if err != nil {
+			return -1, err
+		}
+		defer unlock()
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin = os.Stdin
+	setProcessGroup(cmd)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return -1, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return -1, err
+	}
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		host, _ := os.Hostname()
+		msg := fmt.Sprintf(":x: Couldn't run on `%s`: `%s`: %v", host, commandLine(argv), err)
+		if nerr := f.notice(msg); nerr != nil {
+			return -1, nerr
+		}
+		return -1, err
+	}
+
+	pr, pw := io.Pipe()
+	out := &output{
+		w:    pw,
+		tail: window{maxLines: runTailLines},
+	}
+
+	exited := make(chan struct{})
+	var elapsed time.Duration
+
+	go func() {
+		defer close(exited)
+
+		var wg sync.WaitGroup
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			out.copyLines(stdout, "")
+		}()
+		go func() {
+			defer wg.Done()
+			out.copyLines(stderr, opts.StderrPrefix)
+		}()
+		wg.Wait()
+
+		// the exit code is read from cmd.ProcessState below
+		cmd.Wait()
+		elapsed = time.Since(start)
+		pw.Close()
+	}()
+
+	timedOut := supervise(ctx, cmd, opts.Timeout, opts.KillGrace, exited)
+
+	if opts.Report == ReportAlways {
+		err = f.follow(ctx, pr)
+
+		// don't block the command's output if we stopped reading it early
+		pr.CloseWithError(io.ErrClosedPipe)
+		<-exited
+	} else {
+		buf := &headTail{
+			maxHead: reportedOutputHead,
+			maxTail: reportedOutputTail,
+		}
+
+		io.Copy(buf, pr)
+		<-exited
+
+		select {
+		case <-timedOut:
+			// timeouts are always reported
+		default:
+			if !opts.Report.wants(cmd.ProcessState, buf.size) {
+				return cmd.ProcessState.ExitCode(), nil
+			}
+		}
+		err = f.follow(ctx, buf.reader())
+	}
+
+	code := cmd.ProcessState.ExitCode()
+
+	var summary string
+	select {
+	case <-timedOut:
+		code = timeoutExitCode
+		tail := out.tail.String()
+		if opts.Follow.ANSI != KeepANSI {
+			tail = processANSI(tail, StripANSI)
+		}
+		summary = timeoutSummary(argv, opts.Timeout, tail)
+	default:
+		summary = runSummary(argv, cmd.ProcessState, elapsed)
+	}
+
+	if err != nil && err != context.Canceled {
+		return code, err
+	}
+
+	if nerr := f.notice(summary); nerr != nil {
+		return code, nerr
+	}
+	return code, err
+}
+
+// supervise stops the command if it's still running when timeout elapses, or
+// when ctx is cancelled. It's first asked to terminate, then killed if it
+// didn't exit after grace. The returned channel is closed if the command
+// timed out.
+func supervise(ctx context.Context, cmd *exec.Cmd, timeout, grace time.Duration, exited <-chan struct{}) <-chan struct{} {
+	timedOut := make(chan struct{})
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		deadline = t.C
+		go func() {
+			<-exited
+			t.Stop()
+		}()
+	}
+
+	go func() {
+		select {
+		case <-deadline:
+			close(timedOut)
+		case <-ctx.Done():
+		case <-exited:
+			return
+		}
+
+		terminate(cmd)
+
+		select {
+		case <-time.After(grace):
+			kill(cmd)
+		case <-exited:
+		}
+	}()
+
+	return timedOut
+}
+
+// output merges the lines a command writes on its stdout and stderr, keeping
+// the last ones.
+type output struct {
+	mu   sync.Mutex
+	w    io.Writer
+	tail window
+	// line whose beginning was written, if any
+	partial *outputLine
+}
+
+// outputLine is the line being copied from a stream of the command.
+type outputLine struct {
+	prefix string
+	// set if the beginning of the line was written
+	started bool
+}
+
+// copyLines copies the lines read from r to the output, prefixed by prefix.
+// Lines ending with a carriage return are copied as soon as they're read so
+// that progress bars are shown live, and long lines are copied in parts so
+// that they're not kept in memory.
+func (o *output) copyLines(r io.Reader, prefix string) {
+	br := bufio.NewReader(r)
+	cur := &outputLine{prefix: prefix}
+
+	var line []byte
+	// last progress line, until something else is read
+	var progress string
+
+	for {
+		frag, sep, err := scanSegment(br)
+		if err != nil {
+			if len(line) > 0 || cur.started {
+				o.write(cur, string(line), "\n", prefix+string(line))
+			}
+			return
+		}
+
+		line = append(line, frag...)
+
+		var werr error
+		switch {
+		case sep == '\r' && len(line) > 0:
+			progress = prefix + string(line)
+			werr = o.write(cur, string(line), "\r", "")
+		case sep == '\n' && len(line) == 0 && progress != "" && !cur.started:
+			werr = o.endProgress(progress)
+			progress = ""
+		case sep == '\n':
+			werr = o.write(cur, string(line), "\n", prefix+string(line))
+			progress = ""
+		case len(line) >= maxPartialLine:
+			werr = o.write(cur, string(line), "", "")
+		default:
+			continue
+		}
+		line = line[:0]
+
+		if werr != nil {
+			// drain r so that the command doesn't block writing to it
+			io.Copy(ioutil.Discard, br)
+			return
+		}
+	}
+}
+
+// write writes text followed by end to the output, prefixing it if it's the
+// beginning of a line, and adds tailLine to its tail if it's not empty. An
+// empty end means the line continues.
+func (o *output) write(cur *outputLine, text, end, tailLine string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// lines of concurrent copies mustn't be mixed
+	if o.partial != nil && o.partial != cur {
+		if _, err := io.WriteString(o.w, "\n"); err != nil {
+			return err
+		}
+		o.partial.started = false
+		o.partial = nil
+	}
+
+	s := text + end
+	if !cur.started {
+		s = cur.prefix + s
+	}
+
+	cur.started = end == ""
+	o.partial = nil
+	if cur.started {
+		o.partial = cur
+	}
+
+	if tailLine != "" {
+		o.tail.add(tailLine)
+	}
+	_, err := io.WriteString(o.w, s)
+	return err
+}
+
+// endProgress tells that the last progress line written is complete.
+func (o *output) endProgress(progress string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.tail.add(progress)
+	if o.partial != nil {
+		// the progress line was already ended by another copy
+		return nil
+	}
+	_, err := io.WriteString(o.w, "\n")
+	return err
+}
+
+// headTail keeps the beginning and the end of what's written to it.
+type headTail struct {
+	maxHead int
+	maxTail int
+
+	head []byte
+	tail []byte
+	// number of bytes written
+	size int64
+}
+
+func (b *headTail) Write(p []byte) (int, error) {
+	b.size += int64(len(p))
+
+	n := len(p)
+	if room := b.maxHead - len(b.head); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		b.head = append(b.head, p[:room]...)
+		p = p[room:]
+	}
+
+	b.tail = append(b.tail, p...)
+	if len(b.tail) > 2*b.maxTail {
+		// the tail is only trimmed from time to time
+		b.tail = append(b.tail[:0], b.tail[len(b.tail)-b.maxTail:]...)
+	}
+	return n, nil
+}
+
+// reader returns a reader of what was written, with the middle replaced by
+// the number of bytes omitted if it didn't fit. The lines are cut at their
+// boundaries.
+func (b *headTail) reader() io.Reader {
+	tail := b.tail
+	if len(tail) > b.maxTail {
+		tail = tail[len(tail)-b.maxTail:]
+	}
+
+	omitted := b.size - int64(len(b.head)) - int64(len(tail))
+	if omitted == 0 {
+		return io.MultiReader(bytes.NewReader(b.head), bytes.NewReader(tail))
+	}
+
+	head := b.head
+	if i := bytes.LastIndexByte(head, '\n'); i >= 0 {
+		omitted += int64(len(head) - i - 1)
+		head = head[:i+1]
+	}
+	if i := bytes.IndexByte(tail, '\n'); i >= 0 {
+		omitted += int64(i + 1)
+		tail = tail[i+1:]
+	}
+
+	marker := fmt.Sprintf("[%d bytes omitted]\n", omitted)
+	return io.MultiReader(bytes.NewReader(head), strings.NewReader(marker),
+		bytes.NewReader(tail))
+}
+
+// wants reports if the output of a command that exited with the given state
+// after writing size bytes must be posted.
+func (p ReportPolicy) wants(state *os.ProcessState, size int64) bool {
+	switch p {
+	case ReportOutput:
+		return !state.Success() || size > 0
+	case ReportFailure:
+		return !state.Success()
+	}
+	return true
+}
+
+// shellSpecialChars are the characters that must be quoted in a shell word.
+const shellSpecialChars = " \t\n'\"\\$`*?[]{}()<>|&;#~!"
+
+// commandLine returns argv as it could be typed in a shell, single-quoting
+// the arguments that need it.
+func commandLine(argv []string) string {
+	var args []string
+	for _, arg := range argv {
+		if arg == "" || strings.ContainsAny(arg, shellSpecialChars) {
+			arg = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+		args = append(args, arg)
+	}
+	return strings.Join(args, " ")
+}
+
+// runSummary returns a message describing the execution of a command.
+func runSummary(argv []string, state *os.ProcessState, d time.Duration) string {
+	host, _ := os.Hostname()
+
+	var status string
+	switch code := state.ExitCode(); {
+	case code == 0:
+		status = ":white_check_mark: Succeeded"
+	case code > 0:
+		status = fmt.Sprintf(":x: Failed with exit code %d", code)
+	default:
+		status = fmt.Sprintf(":x: Failed (%s)", state)
+	}
+
+	return fmt.Sprintf("%s after %s on `%s`: `%s`",
+		status, formatDuration(d.Round(time.Second)), host, commandLine(argv))
+}
+
+// timeoutSummary returns a message telling that a command timed out, with
+// the last lines of its output.
+func timeoutSummary(argv []string, timeout time.Duration, tail string) string {
+	host, _ := os.Hostname()
+
+	msg := fmt.Sprintf(":hourglass: Timed out after %s on `%s`: `%s`",
+		formatDuration(timeout), host, commandLine(argv))
+	if tail != "" {
+		msg += "\n" + codeBlock(tail, "")
+	}
+	return msg
+}
+
+// formatDuration returns d without its trailing zero units, as in "30m"
+// rather than "30m0s".
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
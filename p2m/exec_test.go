@@ -0,0 +1,48 @@
+package p2m
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{30 * time.Minute, "30m"},
+		{time.Hour, "1h"},
+		{90 * time.Minute, "1h30m"},
+		{time.Hour + time.Second, "1h0m1s"},
+		{45 * time.Second, "45s"},
+		{500 * time.Millisecond, "500ms"},
+		{0, "0s"},
+	}
+
+	for _, test := range tests {
+		if got := formatDuration(test.d); got != test.want {
+			t.Errorf("formatDuration(%s) = %q, want %q", test.d, got, test.want)
+		}
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	tests := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"ls", "-l"}, "ls -l"},
+		{[]string{"echo", ""}, "echo ''"},
+		{[]string{"echo", "a b"}, "echo 'a b'"},
+		{[]string{"echo", "$HOME", "`id`", `a\b`}, "echo '$HOME' '`id`' 'a\\b'"},
+		{[]string{"echo", "it's"}, `echo 'it'\''s'`},
+		{[]string{"ls", "*.go"}, "ls '*.go'"},
+		{[]string{"sh", "-c", "a && b"}, "sh -c 'a && b'"},
+	}
+
+	for _, test := range tests {
+		if got := commandLine(test.argv); got != test.want {
+			t.Errorf("commandLine(%q) = %q, want %q", test.argv, got, test.want)
+		}
+	}
+}
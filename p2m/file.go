@@ -0,0 +1,603 @@
+package p2m
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Followed files are checked for new lines at this interval.
+	filePollInterval = time.Second
+	// The state file is saved at most at this interval while following.
+	stateSaveInterval = 10 * time.Second
+	// A removed file is still read during this time in case its writer
+	// didn't switch to its replacement yet.
+	fileGoneTimeout = time.Minute
+	// Lines longer than this are passed on in parts.
+	maxPartialLine = 64 * 1024
+)
+
+// fileState is the saved position of a followed file.
+type fileState struct {
+	Id     uint64 `json:"id,omitempty"`
+	Offset int64  `json:"offset"`
+}
+
+// tailedFile is a followed file.
+type tailedFile struct {
+	path string
+	f    *os.File
+	info os.FileInfo
+
+	// offset of the end of what was passed on, and of the last complete
+	// line
+	offset  int64
+	lineEnd int64
+	// beginning of the current line
+	partial []byte
+	// set if the beginning of the current line was already passed on
+	midLine bool
+
+	goneSince time.Time
+}
+
+// droppedFile is a file that stopped being followed.
+type droppedFile struct {
+	info os.FileInfo
+	// offset of the end of what was passed on
+	offset int64
+	since  time.Time
+}
+
+// tailer follows files, like tail -F.
+type tailer struct {
+	patterns  []string
+	statePath string
+	// prefix the lines with the path of their file
+	prefix bool
+
+	files map[string]*tailedFile
+	// state of the files when the tailer started
+	saved map[string]fileState
+	// files recently stopped being followed, in case they match again
+	// under another name
+	dropped []droppedFile
+
+	w io.Writer
+	// number of line feeds passed on
+	feeds int
+
+	mu sync.Mutex
+	// states of the files after each line passed on, that weren't posted
+	// yet
+	checkpoints []tailCheckpoint
+	// number of lines posted, and state of the files after them until it's
+	// saved
+	posted    int
+	acked     map[string]fileState
+	lastSaved time.Time
+}
+
+// tailCheckpoint is the state of the files after the given number of line
+// feeds were passed on.
+type tailCheckpoint struct {
+	feeds int
+	state map[string]fileState
+}
+
+// TailReader reads the lines appended to followed files.
+type TailReader struct {
+	*io.PipeReader
+	t *tailer
+}
+
+// TailFiles returns a reader of the lines appended to the files matching the
+// glob patterns, following them through truncation and rotation like
+// tail -F. Files matching them later are read from their start, unless
+// they're followed files that were renamed. When ctx is
+// cancelled the reader returns io.EOF after the last complete line.
+//
+// If statePath isn't empty the offsets of the lines posted are saved there
+// by Checkpoint and SaveState, so that the next call resumes where this one
+// stopped. Existing files that aren't in the state are read from their end,
+// and files found in it under another path, e.g. after a rotation, from
+// their saved offset.
+func TailFiles(ctx context.Context, patterns []string, statePath string) (*TailReader, error) {
+	t := &tailer{
+		patterns:  patterns,
+		statePath: statePath,
+		files:     make(map[string]*tailedFile),
+		saved:     make(map[string]fileState),
+	}
+
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+	t.prefix = len(patterns) > 1 || hasMeta(patterns[0])
+
+	if statePath != "" {
+		data, err := ioutil.ReadFile(statePath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &t.saved); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := t.scan(true); err != nil {
+		return nil, err
+	}
+
+	r, w := io.Pipe()
+	t.w = w
+
+	go func() {
+		w.CloseWithError(t.run(ctx))
+	}()
+
+	return &TailReader{r, t}, nil
+}
+
+// Checkpoint tells that the given number of lines were posted. The offsets
+// of their end are saved, at most every 10s.
+func (r *TailReader) Checkpoint(lines int) {
+	t := r.t
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.posted = lines
+	t.saveAcked()
+}
+
+// SaveState saves the offsets of the end of what was read, once it was
+// posted. It must only be called after the reader returned io.EOF.
+func (r *TailReader) SaveState() error {
+	return r.t.save(r.t.state())
+}
+
+// hasMeta reports if pattern contains glob metacharacters.
+func hasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// run follows the files until ctx is cancelled.
+func (t *tailer) run(ctx context.Context) error {
+	ticker := time.NewTicker(filePollInterval)
+	defer ticker.Stop()
+	defer t.close()
+
+	for {
+		if err := t.poll(); err != nil {
+			return err
+		}
+
+		t.mu.Lock()
+		t.saveAcked()
+		t.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan starts following the files that match the patterns and aren't
+// followed yet.
+func (t *tailer) scan(first bool) error {
+	t.forgetDropped()
+
+	for _, pattern := range t.patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+
+		for _, path := range paths {
+			if _, ok := t.files[path]; ok {
+				continue
+			}
+
+			if !first && t.rename(path) {
+				continue
+			}
+
+			tf, err := t.open(path, first)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if tf != nil {
+				t.files[path] = tf
+			}
+		}
+	}
+	return nil
+}
+
+// open opens a file to follow. Files that were already there when the tailer
+// started are read from their saved offset, or from their end if there's
+// none.
+func (t *tailer) open(path string, first bool) (*tailedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, nil
+	}
+
+	tf := &tailedFile{path: path, f: f, info: info}
+
+	if !first {
+		// e.g. a rotated file matching the patterns under its new name
+		for i, d := range t.dropped {
+			if os.SameFile(info, d.info) && d.offset <= info.Size() {
+				tf.offset = d.offset
+				t.dropped = append(t.dropped[:i], t.dropped[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if first {
+		tf.offset = info.Size()
+
+		id := fileId(info)
+		if st, ok := t.savedFile(id); ok {
+			if st.Offset <= info.Size() {
+				tf.offset = st.Offset
+			} else {
+				tf.offset = 0
+			}
+		} else if st, ok := t.saved[path]; ok {
+			switch {
+			case st.Id != 0 && id != 0 && st.Id != id:
+				// rotated while not following it
+				tf.offset = 0
+			case st.Offset <= info.Size():
+				tf.offset = st.Offset
+			default:
+				// truncated while not following it
+				tf.offset = 0
+			}
+		}
+	}
+
+	if _, err := f.Seek(tf.offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	tf.lineEnd = tf.offset
+	return tf, nil
+}
+
+// savedFile returns the saved state of the file with the given id, whatever
+// its path was.
+func (t *tailer) savedFile(id uint64) (fileState, bool) {
+	if id == 0 {
+		return fileState{}, false
+	}
+
+	for _, st := range t.saved {
+		if st.Id == id {
+			return st, true
+		}
+	}
+	return fileState{}, false
+}
+
+// rename keeps following a followed file that now matches the patterns under
+// another path, instead of reading it again from its start. It reports if
+// path was such a file.
+func (t *tailer) rename(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	for old, tf := range t.files {
+		if !os.SameFile(info, tf.info) {
+			continue
+		}
+		if oi, err := os.Stat(old); err == nil && os.SameFile(oi, info) {
+			// hard link
+			return false
+		}
+
+		delete(t.files, old)
+		tf.path = path
+		tf.goneSince = time.Time{}
+		t.files[path] = tf
+		return true
+	}
+	return false
+}
+
+// forgetDropped forgets the files dropped for too long to be renamed ones.
+func (t *tailer) forgetDropped() {
+	var kept []droppedFile
+	for _, d := range t.dropped {
+		if time.Since(d.since) <= fileGoneTimeout {
+			kept = append(kept, d)
+		}
+	}
+	t.dropped = kept
+}
+
+// poll passes on the lines appended to the files since the last poll.
+func (t *tailer) poll() error {
+	if err := t.scan(false); err != nil {
+		return err
+	}
+
+	for path, tf := range t.files {
+		if err := t.read(tf); err != nil {
+			return err
+		}
+
+		info, err := os.Stat(path)
+		switch {
+		case os.IsNotExist(err):
+			// removed or renamed, and not replaced yet
+			if tf.goneSince.IsZero() {
+				tf.goneSince = time.Now()
+			}
+			if time.Since(tf.goneSince) > fileGoneTimeout {
+				if err := t.drop(tf); err != nil {
+					return err
+				}
+			}
+
+		case err != nil:
+			return err
+
+		case !os.SameFile(info, tf.info):
+			// rotated: the old file was read until its end above
+			if err := t.drop(tf); err != nil {
+				return err
+			}
+			nf, err := t.open(path, false)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if nf != nil {
+				t.files[path] = nf
+				if err := t.read(nf); err != nil {
+					return err
+				}
+			}
+
+		case info.Size() < tf.offset+int64(len(tf.partial)):
+			// truncated
+			if err := t.endLine(tf); err != nil {
+				return err
+			}
+			if _, err := tf.f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			tf.offset = 0
+			tf.lineEnd = 0
+			tf.goneSince = time.Time{}
+			t.checkpoint()
+
+		default:
+			tf.goneSince = time.Time{}
+		}
+	}
+
+	return nil
+}
+
+// read passes on the complete lines appended to a file.
+func (t *tailer) read(tf *tailedFile) error {
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, err := tf.f.Read(buf)
+		if n > 0 {
+			data := append(tf.partial, buf[:n]...)
+
+			i := bytes.LastIndexByte(data, '\n')
+			if i >= 0 {
+				if err := t.write(tf, data[:i+1]); err != nil {
+					return err
+				}
+				tf.offset += int64(i + 1)
+				tf.lineEnd = tf.offset
+				data = data[i+1:]
+				t.checkpoint()
+			}
+
+			if len(data) > maxPartialLine {
+				if err := t.write(tf, data); err != nil {
+					return err
+				}
+				tf.offset += int64(len(data))
+				data = nil
+			}
+
+			tf.partial = append([]byte(nil), data...)
+		}
+
+		if err == io.EOF || n == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// write passes on data, which ends with a newline unless it's the beginning
+// of a long line.
+func (t *tailer) write(tf *tailedFile, data []byte) error {
+	defer func() {
+		t.feeds += bytes.Count(data, []byte{'\n'})
+	}()
+
+	if !t.prefix {
+		_, err := t.w.Write(data)
+		tf.midLine = data[len(data)-1] != '\n'
+		return err
+	}
+
+	var buf bytes.Buffer
+	for len(data) > 0 {
+		if !tf.midLine {
+			buf.WriteString("[" + tf.path + "] ")
+		}
+
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			buf.Write(data)
+			tf.midLine = true
+			break
+		}
+		buf.Write(data[:i+1])
+		data = data[i+1:]
+		tf.midLine = false
+	}
+
+	_, err := t.w.Write(buf.Bytes())
+	return err
+}
+
+// endLine passes on the last line of a file even if it doesn't end with a
+// newline.
+func (t *tailer) endLine(tf *tailedFile) error {
+	if len(tf.partial) == 0 && !tf.midLine {
+		return nil
+	}
+
+	line := append(tf.partial, '\n')
+	tf.partial = nil
+	return t.write(tf, line)
+}
+
+// drop stops following a file.
+func (t *tailer) drop(tf *tailedFile) error {
+	delete(t.files, tf.path)
+	tf.f.Close()
+
+	t.dropped = append(t.dropped, droppedFile{
+		info:   tf.info,
+		offset: tf.offset + int64(len(tf.partial)),
+		since:  time.Now(),
+	})
+	if err := t.endLine(tf); err != nil {
+		return err
+	}
+	t.checkpoint()
+	return nil
+}
+
+// close stops following the files.
+func (t *tailer) close() {
+	for _, tf := range t.files {
+		tf.f.Close()
+	}
+}
+
+// checkpoint records the state of the files after the lines passed on, to
+// save it once they're posted.
+func (t *tailer) checkpoint() {
+	if t.statePath == "" {
+		return
+	}
+
+	c := tailCheckpoint{t.feeds, t.state()}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n := len(t.checkpoints); n > 0 && t.checkpoints[n-1].feeds == c.feeds {
+		t.checkpoints[n-1] = c
+	} else {
+		t.checkpoints = append(t.checkpoints, c)
+	}
+	t.saveAcked()
+}
+
+// saveAcked saves the state of the files after the last lines posted, if
+// it wasn't saved yet and the last save is old enough. t.mu must be held.
+func (t *tailer) saveAcked() {
+	// the lines may be posted before their checkpoint is recorded
+	i := 0
+	for i < len(t.checkpoints) && t.checkpoints[i].feeds <= t.posted {
+		i++
+	}
+	if i > 0 {
+		t.acked = t.checkpoints[i-1].state
+		t.checkpoints = t.checkpoints[i:]
+	}
+
+	if t.acked == nil || time.Since(t.lastSaved) < stateSaveInterval {
+		return
+	}
+
+	if err := t.save(t.acked); err != nil {
+		log.Printf("Can't save the state: %v", err)
+	}
+	t.acked = nil
+}
+
+// state returns the offsets of the end of the last complete lines of the
+// files.
+func (t *tailer) state() map[string]fileState {
+	state := make(map[string]fileState)
+	for path, tf := range t.files {
+		state[path] = fileState{
+			Id:     fileId(tf.info),
+			Offset: tf.lineEnd,
+		}
+	}
+	return state
+}
+
+// save saves the offsets of the files in the state file.
+func (t *tailer) save(state map[string]fileState) error {
+	t.lastSaved = time.Now()
+
+	if t.statePath == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// the state is written in a temporary file first so that it's never
+	// read half-written
+	tmp := t.statePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.statePath)
+}
@@ -0,0 +1,279 @@
+package p2m
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestTailer returns a tailer of the files matching pattern in dir, which
+// writes to out.
+func newTestTailer(dir, pattern string, out *bytes.Buffer) *tailer {
+	return &tailer{
+		patterns: []string{filepath.Join(dir, pattern)},
+		files:    make(map[string]*tailedFile),
+		saved:    make(map[string]fileState),
+		w:        out,
+	}
+}
+
+func appendFile(t *testing.T, path, text string) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(text); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTailerPoll(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		// applied to app.log in the directory, each followed by a poll
+		steps []func(t *testing.T, path string)
+		want  string
+	}{
+		{
+			"append",
+			"app.log",
+			[]func(*testing.T, string){
+				func(t *testing.T, path string) { appendFile(t, path, "a\nb") },
+				func(t *testing.T, path string) { appendFile(t, path, "c\nd\n") },
+			},
+			"a\nbc\nd\n",
+		},
+		{
+			"truncation",
+			"app.log",
+			[]func(*testing.T, string){
+				func(t *testing.T, path string) { appendFile(t, path, "a\nb\n") },
+				func(t *testing.T, path string) {
+					if err := ioutil.WriteFile(path, []byte("c\n"), 0644); err != nil {
+						t.Fatal(err)
+					}
+				},
+				// the file is read again from its start by the next poll
+				func(*testing.T, string) {},
+			},
+			"a\nb\nc\n",
+		},
+		{
+			"rotation",
+			"app.log",
+			[]func(*testing.T, string){
+				func(t *testing.T, path string) { appendFile(t, path, "a\n") },
+				func(t *testing.T, path string) {
+					appendFile(t, path, "b\n")
+					if err := os.Rename(path, path+".1"); err != nil {
+						t.Fatal(err)
+					}
+					appendFile(t, path, "c\n")
+				},
+			},
+			"a\nb\nc\n",
+		},
+		{
+			"rotation to a matching name",
+			"app.log*",
+			[]func(*testing.T, string){
+				func(t *testing.T, path string) { appendFile(t, path, "a\n") },
+				func(t *testing.T, path string) {
+					if err := os.Rename(path, path+".1"); err != nil {
+						t.Fatal(err)
+					}
+					appendFile(t, path, "c\n")
+				},
+				// the new file is found by the next poll
+				func(*testing.T, string) {},
+				func(t *testing.T, path string) { appendFile(t, path+".1", "b\n") },
+			},
+			"a\nc\nb\n",
+		},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "p2m-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "app.log")
+		// existing files are read from their end
+		appendFile(t, path, "old\n")
+
+		var out bytes.Buffer
+		tl := newTestTailer(dir, test.pattern, &out)
+		if err := tl.scan(true); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, step := range test.steps {
+			step(t, path)
+			if err := tl.poll(); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		tl.close()
+
+		if got := out.String(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTailerSavedState(t *testing.T) {
+	tests := []struct {
+		name  string
+		saved func(id uint64) map[string]fileState
+		want  string
+	}{
+		{
+			"not saved",
+			func(uint64) map[string]fileState { return nil },
+			"",
+		},
+		{
+			"saved",
+			func(id uint64) map[string]fileState {
+				return map[string]fileState{"app.log": {id, 2}}
+			},
+			"b\n",
+		},
+		{
+			"replaced",
+			func(id uint64) map[string]fileState {
+				return map[string]fileState{"app.log": {id + 1, 2}}
+			},
+			"a\nb\n",
+		},
+		{
+			"truncated",
+			func(id uint64) map[string]fileState {
+				return map[string]fileState{"app.log": {id, 100}}
+			},
+			"a\nb\n",
+		},
+		{
+			"renamed",
+			func(id uint64) map[string]fileState {
+				return map[string]fileState{"app.log.0": {id, 2}}
+			},
+			"b\n",
+		},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "p2m-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "app.log")
+		appendFile(t, path, "a\nb\n")
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		tl := newTestTailer(dir, "app.log", &out)
+		for p, st := range test.saved(fileId(info)) {
+			tl.saved[filepath.Join(dir, p)] = st
+		}
+
+		if err := tl.scan(true); err != nil {
+			t.Fatal(err)
+		}
+		if err := tl.poll(); err != nil {
+			t.Fatal(err)
+		}
+		tl.close()
+
+		if got := out.String(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTailerCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2m-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "")
+
+	var out bytes.Buffer
+	tl := newTestTailer(dir, "app.log", &out)
+	tl.statePath = filepath.Join(dir, "state.json")
+	r := &TailReader{t: tl}
+
+	if err := tl.scan(true); err != nil {
+		t.Fatal(err)
+	}
+	defer tl.close()
+
+	savedOffset := func() int64 {
+		data, err := ioutil.ReadFile(tl.statePath)
+		if os.IsNotExist(err) {
+			return -1
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var state map[string]fileState
+		if err := json.Unmarshal(data, &state); err != nil {
+			t.Fatal(err)
+		}
+		return state[path].Offset
+	}
+
+	appendFile(t, path, "a\n")
+	tl.poll()
+	appendFile(t, path, "b\nc\npartial")
+	tl.poll()
+
+	// the lines are posted after their checkpoint is recorded
+	r.Checkpoint(1)
+	if got := savedOffset(); got != 2 {
+		t.Errorf("offset saved after 1 line = %d, want 2", got)
+	}
+
+	// the lines of the second write aren't all posted yet
+	r.Checkpoint(2)
+	if got := savedOffset(); got != 2 {
+		t.Errorf("offset saved after 2 lines = %d, want 2", got)
+	}
+
+	// saves are delayed, then done while following the files
+	r.Checkpoint(3)
+	if got := savedOffset(); got != 2 {
+		t.Errorf("offset saved right after another save = %d, want 2", got)
+	}
+	tl.lastSaved = tl.lastSaved.Add(-stateSaveInterval)
+	tl.mu.Lock()
+	tl.saveAcked()
+	tl.mu.Unlock()
+	if got := savedOffset(); got != 6 {
+		t.Errorf("offset saved after 3 lines = %d, want 6", got)
+	}
+
+	// the lines are posted before their checkpoint is recorded
+	r.Checkpoint(4)
+	appendFile(t, path, "\n")
+	tl.lastSaved = tl.lastSaved.Add(-stateSaveInterval)
+	tl.poll()
+	if got := savedOffset(); got != 14 {
+		t.Errorf("offset saved after 4 lines = %d, want 14", got)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package p2m
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileId returns the inode of a file, which stays the same when it's renamed.
+func fileId(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
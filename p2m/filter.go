@@ -0,0 +1,98 @@
+package p2m
+
+import (
+	"regexp"
+	"strings"
+)
+
+// filter selects the lines that are posted, like grep.
+type filter struct {
+	include   []*regexp.Regexp
+	exclude   []*regexp.Regexp
+	skipBlank bool
+	invert    bool
+	context   int
+
+	// last lines that didn't match, up to context
+	before []input
+	// number of lines still passed after the last match
+	after int
+	// set if lines were dropped since the last passed one
+	gap bool
+	// set once a line has been passed
+	passed bool
+}
+
+// newFilter returns the filter described by opts, or nil if all lines are
+// posted.
+func newFilter(opts FollowOptions) *filter {
+	if len(opts.Include) == 0 && len(opts.Exclude) == 0 && !opts.SkipBlank && !opts.Invert {
+		return nil
+	}
+
+	return &filter{
+		include:   opts.Include,
+		exclude:   opts.Exclude,
+		skipBlank: opts.SkipBlank,
+		invert:    opts.Invert,
+		context:   opts.Context,
+	}
+}
+
+// match reports if line is selected by the filter, regardless of its context.
+func (fl *filter) match(line string) bool {
+	ok := len(fl.include) == 0
+	for _, re := range fl.include {
+		if re.MatchString(line) {
+			ok = true
+			break
+		}
+	}
+
+	if ok {
+		for _, re := range fl.exclude {
+			if re.MatchString(line) {
+				ok = false
+				break
+			}
+		}
+	}
+
+	return ok != fl.invert
+}
+
+// add returns the lines to post after in is read: none, or in preceded by its
+// context. Groups of lines that aren't contiguous are separated by "--".
+func (fl *filter) add(in input) []input {
+	if fl.skipBlank && strings.TrimSpace(in.text) == "" {
+		return nil
+	}
+
+	if !fl.match(in.text) {
+		if fl.after > 0 {
+			fl.after--
+			return []input{in}
+		}
+
+		fl.before = append(fl.before, in)
+		if len(fl.before) > fl.context {
+			fl.before = fl.before[1:]
+			fl.gap = true
+		}
+		return nil
+	}
+
+	var lines []input
+	if fl.gap && fl.passed && fl.context > 0 {
+		lines = append(lines, input{text: "--"})
+	}
+	lines = append(lines, fl.before...)
+	lines = append(lines, in)
+
+	fl.before = nil
+	fl.after = fl.context
+	fl.gap = false
+	fl.passed = true
+
+	return lines
+}
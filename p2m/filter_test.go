@@ -0,0 +1,89 @@
+package p2m
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestFilterAdd(t *testing.T) {
+	errors := []*regexp.Regexp{regexp.MustCompile(`ERROR`)}
+	debug := []*regexp.Regexp{regexp.MustCompile(`DEBUG`)}
+
+	tests := []struct {
+		name  string
+		opts  FollowOptions
+		lines []string
+		want  []string
+	}{
+		{
+			"include",
+			FollowOptions{Include: errors},
+			[]string{"a", "ERROR 1", "b", "ERROR 2"},
+			[]string{"ERROR 1", "ERROR 2"},
+		},
+		{
+			"exclude",
+			FollowOptions{Exclude: debug},
+			[]string{"a", "DEBUG x", "b"},
+			[]string{"a", "b"},
+		},
+		{
+			"include and exclude",
+			FollowOptions{Include: errors, Exclude: debug},
+			[]string{"ERROR 1", "DEBUG ERROR 2", "a"},
+			[]string{"ERROR 1"},
+		},
+		{
+			"invert",
+			FollowOptions{Include: errors, Invert: true},
+			[]string{"a", "ERROR 1", "b"},
+			[]string{"a", "b"},
+		},
+		{
+			"skip blank lines",
+			FollowOptions{SkipBlank: true},
+			[]string{"a", "", "  \t", "b"},
+			[]string{"a", "b"},
+		},
+		{
+			"context",
+			FollowOptions{Include: errors, Context: 1},
+			[]string{"a", "b", "ERROR 1", "c", "d", "e", "ERROR 2", "f"},
+			[]string{"b", "ERROR 1", "c", "--", "e", "ERROR 2", "f"},
+		},
+		{
+			"contiguous context",
+			FollowOptions{Include: errors, Context: 2},
+			[]string{"a", "ERROR 1", "b", "c", "ERROR 2", "d"},
+			[]string{"a", "ERROR 1", "b", "c", "ERROR 2", "d"},
+		},
+		{
+			"context at the start",
+			FollowOptions{Include: errors, Context: 2},
+			[]string{"a", "b", "c", "ERROR 1"},
+			[]string{"b", "c", "ERROR 1"},
+		},
+	}
+
+	for _, test := range tests {
+		fl := newFilter(test.opts)
+
+		var got []string
+		for _, line := range test.lines {
+			for _, in := range fl.add(input{text: line}) {
+				got = append(got, in.text)
+			}
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNewFilter(t *testing.T) {
+	if fl := newFilter(FollowOptions{Context: 3}); fl != nil {
+		t.Errorf("newFilter without filters = %+v, want nil", fl)
+	}
+}
@@ -0,0 +1,896 @@
+package p2m
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mattermost/platform/model"
+)
+
+type FollowOptions struct {
+	// Update continuously updates the same message instead of posting new
+	// ones.
+	Update bool
+
+	// Lines are gathered in a single post which is sent when BatchInterval
+	// elapses after its first line, when it has BatchLines lines or when it
+	// nears the maximum message size, whichever comes first. If both are
+	// zero each line is posted on its own, except with table formats where
+	// posts are filled up to their maximum size.
+	BatchInterval time.Duration
+	BatchLines    int
+
+	// Code wraps each message in a code block, with CodeLang as its
+	// language hint.
+	Code     bool
+	CodeLang string
+
+	// When updating the same message, TailLines and TailRunes limit it to
+	// the last lines read. If Archive is set, lines that scroll out of it
+	// are uploaded as a file at the end of the stream, or in parts as soon
+	// as they reach the maximum upload size.
+	TailLines int
+	TailRunes int
+	Archive   bool
+
+	// Thread posts the first message as a thread root and the following
+	// ones as replies to it. If ThreadSummary is set the root is updated
+	// with the number of lines and the duration at the end of the stream.
+	Thread        bool
+	ThreadSummary bool
+
+	// RecordStart matches the lines that start a new record. The following
+	// ones are joined to it until the next match or until no line has been
+	// read for RecordTimeout.
+	RecordStart   *regexp.Regexp
+	RecordTimeout time.Duration
+
+	// Lines longer than MaxLineLength bytes, 64KiB if it's 0, are handled
+	// according to LongLines.
+	MaxLineLength int
+	LongLines     LongLinePolicy
+
+	// Spool saves the messages that can't be sent because the server is
+	// unreachable, and sends them once it's back.
+	Spool *Spool
+
+	// InterruptNotice is posted when the stream is interrupted by the
+	// cancellation of the context, if it's not empty.
+	InterruptNotice string
+
+	// Drain keeps reading the input until its end when the context is
+	// cancelled, for inputs that end on their own once interrupted. The
+	// stream is still considered interrupted.
+	Drain bool
+
+	// Checkpoint, if not nil, is called with the number of lines of the
+	// input that were posted or spooled whenever all the ones read so far
+	// were.
+	Checkpoint func(lines int)
+
+	// The current batch is sent as soon as something is received on Flush.
+	Flush <-chan struct{}
+
+	// Tee, if not nil, receives a copy of the input as soon as it's read,
+	// regardless of how long it takes to post it, unless posting falls 16MiB
+	// behind: the input is then read only as fast as it's posted.
+	Tee io.Writer
+
+	// Only the lines that match one of the Include regexps, if any, and none
+	// of the Exclude ones are posted, along with Context lines before and
+	// after them. Invert posts the other lines instead. SkipBlank drops the
+	// lines that only contain whitespace. When RecordStart is set the
+	// filters apply to whole records.
+	Include   []*regexp.Regexp
+	Exclude   []*regexp.Regexp
+	Invert    bool
+	SkipBlank bool
+	Context   int
+
+	// If Levels is set the level of each line is detected with its patterns.
+	// Warnings and errors are posted as colored attachments, and lines of
+	// different levels aren't batched together. Lines that don't match any
+	// pattern are part of the current batch, if any.
+	Levels LevelPatterns
+
+	// Dedup collapses consecutive identical lines: only the first one is
+	// posted, followed by the number of times it was repeated once another
+	// line is read or DedupInterval elapses. DedupNormalize ignores numbers
+	// and UUIDs when comparing lines.
+	Dedup          bool
+	DedupNormalize bool
+	DedupInterval  time.Duration
+
+	// With JSONFormat each line is parsed as a JSON object and posted as an
+	// attachment. Its text is the value of the first of MessageKeys it has,
+	// its color depends on the value of LevelKey, and the values of
+	// FieldKeys are shown below it. Lines that aren't JSON objects are
+	// posted as plain text.
+	// With CSVFormat, TSVFormat and ColumnsFormat lines are posted as the
+	// rows of a markdown table, the first one being its header, which is
+	// repeated in each post.
+	Format      InputFormat
+	MessageKeys []string
+	LevelKey    string
+	FieldKeys   []string
+
+	// Template, if not nil, renders the lines of each message. With
+	// JSONFormat it renders the text of the attachments.
+	Template *template.Template
+
+	// Mentions adds mentions to the posts of the lines matching its rules.
+	// When updating the same message they're posted separately since edits
+	// don't notify anyone.
+	Mentions []MentionRule
+
+	// ANSI tells what to do with the escape sequences of the input.
+	ANSI ANSIMode
+
+	// Lines redrawn in place with carriage returns, like progress bars, are
+	// shown live when updating the same message, refreshing it at most once
+	// per ProgressInterval. Otherwise only their final state is posted.
+	ProgressInterval time.Duration
+}
+
+type follower struct {
+	c         *Client
+	channelId string
+	opts      FollowOptions
+
+	postId string
+	rootId string
+	fence  string
+
+	start time.Time
+	count int
+
+	// line feeds read, and posted when Checkpoint was last called
+	feeds        int
+	checkpointed int
+
+	interrupted bool
+
+	batch batch
+	timer *time.Timer
+	// level of the lines of the batch
+	level Level
+	// line numbers and times of the batch, for the template
+	meta []lineMeta
+
+	records     *records
+	recordTimer *time.Timer
+
+	filter    *filter
+	mentioner *mentioner
+	table     *table
+
+	dedup      *dedup
+	dedupTimer *time.Timer
+
+	window *window
+	// last message sent in update mode, without the progress line
+	last string
+
+	progress      string
+	progressTimer *time.Timer
+	progressSent  time.Time
+
+	stopDraining func()
+	// last time the spool was drained before spooling a message
+	drainProbed time.Time
+	// identifies the messages spooled by the follower
+	stream string
+	// file of the latest state spooled in update mode
+	spooledUpdate string
+}
+
+// Follow posts the lines read from r in the given channel until its end or
+// until ctx is cancelled, in which case the pending lines are sent before
+// returning.
+func (c *Client) Follow(ctx context.Context, r io.Reader, channelId string, opts FollowOptions) error {
+	return c.newFollower(channelId, opts).follow(ctx, r)
+}
+
+func (c *Client) newFollower(channelId string, opts FollowOptions) *follower {
+	f := &follower{
+		c:         c,
+		channelId: channelId,
+		opts:      opts,
+		start:     time.Now(),
+		batch: batch{
+			maxLines: opts.BatchLines,
+			maxRunes: model.POST_MESSAGE_MAX_RUNES - splitReserve,
+		},
+	}
+
+	if opts.Code {
+		f.batch.maxRunes -= utf8.RuneCountInString(opts.CodeLang) + 10
+	}
+	if opts.RecordStart != nil {
+		f.records = &records{start: opts.RecordStart}
+	}
+	f.filter = newFilter(opts)
+	switch opts.Format {
+	case CSVFormat, TSVFormat, ColumnsFormat:
+		f.table = &table{format: opts.Format}
+	}
+	// the rows of tables are only limited by the post size
+	if opts.BatchLines == 0 && opts.BatchInterval == 0 && f.table == nil {
+		f.batch.maxLines = 1
+	}
+	if opts.Dedup {
+		f.dedup = &dedup{normalize: opts.DedupNormalize}
+	}
+	f.mentioner = newMentioner(opts.Mentions)
+	if opts.Spool != nil {
+		f.stream = fmt.Sprintf("%d-%d", os.Getpid(), f.start.UnixNano())
+	}
+	if opts.Update && (opts.TailLines > 0 || opts.TailRunes > 0) {
+		f.window = &window{
+			maxLines: opts.TailLines,
+			maxRunes: opts.TailRunes,
+		}
+		if opts.Archive {
+			f.window.archive = &archive{}
+		}
+	}
+
+	return f
+}
+
+func (f *follower) follow(ctx context.Context, r io.Reader) error {
+	opts := f.opts
+
+	if opts.Spool != nil {
+		f.stopDraining = f.drainInBackground()
+		defer f.stopDraining()
+	}
+
+	if f.window != nil && f.window.archive != nil {
+		defer f.window.archive.close()
+	}
+
+	if opts.Tee != nil {
+		r = newAsyncTee(r, opts.Tee)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	lines, errc := readLines(r, opts.MaxLineLength, opts.LongLines, done)
+	cancelled := ctx.Done()
+
+	for {
+		f.checkpoint()
+
+		select {
+		case in, ok := <-lines:
+			if !ok {
+				if opts.Drain && ctx.Err() != nil {
+					f.interrupted = true
+				}
+				if err := f.close(); err != nil {
+					return err
+				}
+				if err := <-errc; err != nil || !f.interrupted {
+					return err
+				}
+				return ctx.Err()
+			}
+			if err := f.read(in); err != nil {
+				return err
+			}
+
+		case <-timerC(f.timer):
+			f.timer = nil
+			if err := f.flushWhenReady(); err != nil {
+				return err
+			}
+
+		case <-timerC(f.recordTimer):
+			if err := f.flushRecord(); err != nil {
+				return err
+			}
+
+		case <-timerC(f.dedupTimer):
+			f.dedupTimer = nil
+			if err := f.flushRepeats(); err != nil {
+				return err
+			}
+
+		case <-timerC(f.progressTimer):
+			f.progressTimer = nil
+			if err := f.refresh(); err != nil {
+				return err
+			}
+
+		case <-opts.Flush:
+			if err := f.flushRecord(); err != nil {
+				return err
+			}
+			if err := f.flushRepeats(); err != nil {
+				return err
+			}
+			if err := f.flush(); err != nil {
+				return err
+			}
+
+		case <-cancelled:
+			f.interrupted = true
+			if opts.Drain {
+				cancelled = nil
+				continue
+			}
+			if err := f.close(); err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// checkpoint tells that the lines read so far were posted, if none of them
+// is pending.
+func (f *follower) checkpoint() {
+	if f.opts.Checkpoint == nil || f.feeds == f.checkpointed {
+		return
+	}
+
+	switch {
+	case !f.batch.empty():
+		return
+	case f.records != nil && len(f.records.lines) > 0:
+		return
+	case f.dedup != nil && f.dedup.repeats > 0:
+		return
+	}
+
+	f.checkpointed = f.feeds
+	f.opts.Checkpoint(f.feeds)
+}
+
+// close sends everything that's pending at the end of the stream.
+func (f *follower) close() error {
+	steps := []func() error{
+		f.flushRecord,
+		f.flushProgress,
+		f.flushRepeats,
+		f.flush,
+		f.notifyInterruption,
+		f.uploadArchive,
+		f.summarizeThread,
+		f.drainSpool,
+	}
+
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read handles a line read from the input.
+func (f *follower) read(in input) error {
+	f.feeds = in.feeds
+
+	if in.progress {
+		return f.readProgress(processANSI(in.text, f.opts.ANSI))
+	}
+
+	f.count++
+	in.num = f.count
+	in.time = time.Now()
+
+	// the line replaces the one that was redrawn, if any
+	f.progress = ""
+	f.stopProgress()
+
+	if in.huge {
+		if f.filter != nil && !f.filter.match(in.text) {
+			return nil
+		}
+		return f.upload(in.text)
+	}
+
+	in.text = processANSI(in.text, f.opts.ANSI)
+
+	if f.opts.Format == JSONFormat {
+		if a, ok := parseEntry(in.text, f.opts); ok {
+			return f.postEntry(in, a)
+		}
+	}
+
+	if f.table != nil {
+		first := f.table.header == ""
+
+		row, ok := f.table.add(in.text)
+		if !ok {
+			if first && f.table.header != "" {
+				// the header is repeated in each post
+				f.batch.maxRunes -= f.table.headerRunes()
+			}
+			return nil
+		}
+		in.text = row
+	}
+
+	if f.records == nil {
+		return f.pass(in)
+	}
+
+	if f.recordTimer != nil {
+		f.recordTimer.Stop()
+	}
+	if f.opts.RecordTimeout > 0 {
+		f.recordTimer = time.NewTimer(f.opts.RecordTimeout)
+	}
+
+	if rec, ok := f.records.add(in); ok {
+		return f.pass(rec)
+	}
+	return nil
+}
+
+func (f *follower) flushRecord() error {
+	if f.recordTimer != nil {
+		f.recordTimer.Stop()
+		f.recordTimer = nil
+	}
+
+	if f.records == nil {
+		return nil
+	}
+
+	if rec, ok := f.records.take(); ok {
+		return f.pass(rec)
+	}
+	return nil
+}
+
+// readProgress handles a line that will be redrawn in place.
+func (f *follower) readProgress(line string) error {
+	f.progress = line
+
+	if !f.opts.Update || f.progressTimer != nil {
+		return nil
+	}
+
+	d := f.opts.ProgressInterval - time.Since(f.progressSent)
+	if t := f.c.throttled(); t > d {
+		d = t
+	}
+	if d > 0 {
+		f.progressTimer = time.NewTimer(d)
+		return nil
+	}
+
+	return f.refresh()
+}
+
+func (f *follower) stopProgress() {
+	if f.progressTimer != nil {
+		f.progressTimer.Stop()
+		f.progressTimer = nil
+	}
+}
+
+// refresh updates the message with the current progress line.
+func (f *follower) refresh() error {
+	if !f.batch.empty() {
+		return f.flush()
+	}
+	return f.send(f.render(f.last))
+}
+
+// flushProgress sends the current progress line at the end of the stream.
+func (f *follower) flushProgress() error {
+	if f.progress == "" {
+		return nil
+	}
+
+	if f.opts.Update {
+		if f.progressTimer == nil {
+			return nil
+		}
+		return f.refresh()
+	}
+
+	f.count++
+	in := input{text: f.progress, num: f.count, time: time.Now()}
+	f.progress = ""
+	return f.pass(in)
+}
+
+// pass adds a line or a record to the current batch if it passes the filter,
+// along with its context.
+func (f *follower) pass(in input) error {
+	if f.filter == nil {
+		return f.collapse(in)
+	}
+
+	for _, l := range f.filter.add(in) {
+		if err := f.collapse(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collapse adds in to the current batch unless it repeats the previous line.
+func (f *follower) collapse(in input) error {
+	if f.dedup == nil {
+		return f.add(in)
+	}
+
+	summary, ok := f.dedup.add(in)
+	if !ok {
+		if f.dedupTimer == nil && f.opts.DedupInterval > 0 {
+			f.dedupTimer = time.NewTimer(f.opts.DedupInterval)
+		}
+		return nil
+	}
+
+	if summary.text != "" {
+		if err := f.add(summary); err != nil {
+			return err
+		}
+	}
+	f.stopRepeats()
+	return f.add(in)
+}
+
+// flushRepeats sends the number of times the last line was repeated, if any.
+func (f *follower) flushRepeats() error {
+	f.stopRepeats()
+
+	if f.dedup == nil {
+		return nil
+	}
+
+	if summary := f.dedup.take(); summary.text != "" {
+		return f.add(summary)
+	}
+	return nil
+}
+
+func (f *follower) stopRepeats() {
+	if f.dedupTimer != nil {
+		f.dedupTimer.Stop()
+		f.dedupTimer = nil
+	}
+}
+
+// add adds a line or a record to the current batch.
+func (f *follower) add(in input) error {
+	line := in.text
+
+	if f.opts.Levels != nil {
+		level, ok := f.opts.Levels.detect(line)
+		if !ok && !f.batch.empty() {
+			level = f.level
+		}
+
+		if !f.batch.empty() && level != f.level {
+			if err := f.flush(); err != nil {
+				return err
+			}
+		}
+		f.level = level
+	}
+
+	if !f.batch.fits(line) {
+		if err := f.flush(); err != nil {
+			return err
+		}
+	}
+
+	if f.batch.empty() && f.opts.BatchInterval > 0 {
+		f.timer = time.NewTimer(f.opts.BatchInterval)
+	}
+
+	f.batch.add(line)
+	if f.opts.Template != nil {
+		f.meta = append(f.meta, lineMeta{in.num, in.time})
+	}
+	if f.mentioner != nil {
+		f.mentioner.match(line)
+	}
+
+	if f.batch.full() {
+		return f.flushWhenReady()
+	}
+	return nil
+}
+
+// flushWhenReady sends the current batch, or postpones it if the client is
+// throttled so that the lines read in the meantime are sent along.
+func (f *follower) flushWhenReady() error {
+	if d := f.c.throttled(); d > 0 {
+		if f.timer != nil {
+			f.timer.Stop()
+		}
+		f.timer = time.NewTimer(d)
+		return nil
+	}
+
+	return f.flush()
+}
+
+// timerC returns the channel of t, or nil if t is nil so that selecting on it
+// blocks forever.
+func timerC(t *time.Timer) <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.C
+}
+
+func (f *follower) flush() error {
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+
+	if f.batch.empty() {
+		return nil
+	}
+
+	var msg string
+
+	lines := f.batch.takeLines()
+	if f.opts.Template != nil {
+		text, err := executeTemplate(f.opts.Template, lines, f.meta)
+		f.meta = nil
+		if err != nil {
+			// a line the template can't render is posted as it is
+			log.Printf("template: %v", err)
+		} else {
+			lines = []string{text}
+		}
+	}
+
+	if f.window != nil {
+		for _, line := range lines {
+			f.window.add(line)
+		}
+
+		if a := f.window.archive; a != nil && a.size >= maxUploadSize {
+			if err := f.uploadArchivePart(false); err != nil {
+				return err
+			}
+		}
+
+		msg = f.window.String()
+		if !f.opts.Code {
+			msg, _ = balanceFences(msg, f.window.fence)
+		}
+	} else {
+		msg = strings.Join(lines, "\n")
+		if !f.opts.Code {
+			// Code blocks are kept balanced when they span several batches
+			msg, f.fence = balanceFences(msg, f.fence)
+		}
+	}
+
+	if f.table != nil {
+		msg = f.table.header + "\n" + msg
+	}
+
+	if f.opts.Update {
+		f.last = msg
+	}
+
+	var mentions, mentioned string
+	if f.mentioner != nil {
+		mentions, mentioned = f.mentioner.take()
+	}
+
+	if f.level >= WarningLevel {
+		msg = f.render(msg)
+		return f.sendAttachment(mentions, &model.SlackAttachment{
+			Fallback: msg,
+			Color:    levelColors[f.level],
+			Text:     msg,
+		})
+	}
+
+	msg = f.render(msg)
+	if mentions == "" {
+		return f.send(msg)
+	}
+
+	if !f.opts.Update {
+		return f.send(msg + "\n" + mentions)
+	}
+
+	if err := f.send(msg); err != nil {
+		return err
+	}
+	return f.notice(mentions + "\n" + quote(mentioned))
+}
+
+// render returns the message to send for msg, followed by the current
+// progress line in update mode.
+func (f *follower) render(msg string) string {
+	if f.opts.Update && f.progress != "" {
+		f.stopProgress()
+		f.progressSent = time.Now()
+
+		if msg != "" {
+			msg += "\n"
+		}
+		msg += f.progress
+	}
+
+	if f.opts.Code {
+		msg = codeBlock(msg, f.opts.CodeLang)
+	}
+	return msg
+}
+
+func (f *follower) send(msg string) error {
+	m := spooled{Message: msg, Update: f.opts.Update}
+
+	return f.deliver(m, func() (err error) {
+		if f.opts.Update && f.postId != "" {
+			f.postId, err = f.c.Update(f.postId, msg)
+		} else if f.opts.Thread {
+			f.rootId, f.postId, err = f.c.Reply(msg, f.channelId, f.rootId)
+		} else {
+			f.postId, err = f.c.Post(msg, f.channelId)
+		}
+		return
+	})
+}
+
+// postEntry posts the attachment a of the JSON object in on its own, after
+// the pending lines.
+func (f *follower) postEntry(in input, a *model.SlackAttachment) error {
+	line := in.text
+
+	if f.filter != nil && !f.filter.match(line) {
+		return nil
+	}
+
+	steps := []func() error{
+		f.flushRecord,
+		f.flushRepeats,
+		f.flush,
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+
+	if f.opts.Template != nil {
+		text, err := executeTemplate(f.opts.Template, []string{line},
+			[]lineMeta{{in.num, in.time}})
+		if err != nil {
+			// the entry is posted as it would be without the template
+			log.Printf("template: %v", err)
+		} else {
+			a.Text = text
+			a.Fallback = text
+		}
+	}
+
+	var mentions string
+	if f.mentioner != nil {
+		f.mentioner.match(line)
+		mentions, _ = f.mentioner.take()
+	}
+
+	return f.sendAttachment(mentions, a)
+}
+
+// sendAttachment posts a with msg as the message.
+func (f *follower) sendAttachment(msg string, a *model.SlackAttachment) error {
+	return f.deliver(spooled{Message: msg, Attachment: a}, func() error {
+		postId, err := f.c.PostAttachment(msg, a, f.channelId, f.rootId)
+		if err == nil && f.opts.Thread && f.rootId == "" {
+			f.rootId = postId
+		}
+		return err
+	})
+}
+
+// notice posts msg on its own, as a reply in thread mode.
+func (f *follower) notice(msg string) error {
+	return f.deliver(spooled{Message: msg}, func() (err error) {
+		if f.opts.Thread {
+			f.rootId, _, err = f.c.Reply(msg, f.channelId, f.rootId)
+		} else {
+			_, err = f.c.Post(msg, f.channelId)
+		}
+		return
+	})
+}
+
+// upload uploads a line too long to be posted as a file, with a preview of
+// it as the message.
+func (f *follower) upload(line string) error {
+	steps := []func() error{
+		f.flushRecord,
+		f.flushRepeats,
+		f.flush,
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+
+	preview := fmt.Sprintf("%s… (%d bytes, see attachment)",
+		line[:runeOffset(line, 200)], len(line))
+
+	return f.sendFile(preview, "line.txt", []byte(line))
+}
+
+func (f *follower) sendFile(msg, filename string, data []byte) error {
+	m := spooled{Message: msg, Filename: filename, Data: data}
+
+	return f.deliver(m, func() error {
+		postId, err := f.c.PostFile(msg, f.channelId, f.rootId, filename, data)
+		if err == nil && f.opts.Thread && f.rootId == "" {
+			f.rootId = postId
+		}
+		return err
+	})
+}
+
+func (f *follower) uploadArchive() error {
+	if f.window == nil || f.window.archive == nil {
+		return nil
+	}
+	return f.uploadArchivePart(true)
+}
+
+// uploadArchivePart uploads the lines archived since the last part, if any.
+// The last part of an archive uploaded in a single part isn't numbered.
+func (f *follower) uploadArchivePart(last bool) error {
+	a := f.window.archive
+	if a.size == 0 && a.err == nil {
+		return nil
+	}
+
+	data, err := a.take()
+	if err != nil {
+		return err
+	}
+
+	msg := "Lines that scrolled out of the message above"
+	filename := "output.log"
+	if !last || a.parts > 1 {
+		msg += fmt.Sprintf(" (part %d)", a.parts)
+		filename = fmt.Sprintf("output-%d.log", a.parts)
+	}
+
+	return f.sendFile(msg, filename, data)
+}
+
+func (f *follower) notifyInterruption() error {
+	if !f.interrupted || f.opts.InterruptNotice == "" {
+		return nil
+	}
+
+	return f.notice(f.opts.InterruptNotice)
+}
+
+func (f *follower) summarizeThread() error {
+	if !f.opts.ThreadSummary || f.rootId == "" {
+		return nil
+	}
+
+	return f.c.Append(f.rootId, fmt.Sprintf("\n\n_%d lines in %s_",
+		f.count, time.Since(f.start).Round(time.Second)))
+}
@@ -0,0 +1,46 @@
+package p2m
+
+import (
+	"regexp"
+)
+
+// Level is the severity of a line.
+type Level int
+
+const (
+	// InfoLevel lines are posted as plain text
+	InfoLevel Level = iota
+	// WarningLevel lines are posted as yellow attachments
+	WarningLevel
+	// ErrorLevel lines are posted as red attachments
+	ErrorLevel
+)
+
+// Colors of the attachments of each level.
+var levelColors = map[Level]string{
+	WarningLevel: "#ffbc1f",
+	ErrorLevel:   "#d24b4e",
+}
+
+// LevelPatterns match the lines of each level.
+type LevelPatterns map[Level]*regexp.Regexp
+
+// detect returns the level of line: the one of the pattern that matches the
+// earliest in it, so that "INFO: 0 errors" is an info line.
+func (p LevelPatterns) detect(line string) (Level, bool) {
+	var level Level
+	start := -1
+
+	for l, re := range p {
+		loc := re.FindStringIndex(line)
+		if loc == nil {
+			continue
+		}
+		// errors win ties
+		if start < 0 || loc[0] < start || (loc[0] == start && l > level) {
+			level, start = l, loc[0]
+		}
+	}
+
+	return level, start >= 0
+}
@@ -0,0 +1,20 @@
+package p2m
+
+import "os"
+
+// lockFile takes an exclusive lock on the file at path by creating it. It
+// returns errLocked if it already exists, and otherwise a function that
+// releases it by removing the file. Unlike on other systems the lock isn't
+// released if the process dies.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	f.Close()
+
+	return func() { os.Remove(path) }, nil
+}
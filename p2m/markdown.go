@@ -0,0 +1,20 @@
+package p2m
+
+import "strings"
+
+// codeBlock wraps msg in a fenced code block with an optional language hint.
+// The fence is longer than any run of backticks in msg so the latter can't
+// close it.
+func codeBlock(msg, lang string) string {
+	fence := "```"
+	for strings.Contains(msg, fence) {
+		fence += "`"
+	}
+
+	return fence + lang + "\n" + msg + "\n" + fence
+}
+
+// quote returns msg as a blockquote.
+func quote(msg string) string {
+	return "> " + strings.Replace(msg, "\n", "\n> ", -1)
+}
@@ -0,0 +1,106 @@
+package p2m
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MentionRule mentions people in the posts of the lines matching Pattern, at
+// most once per Cooldown.
+type MentionRule struct {
+	Pattern  *regexp.Regexp
+	Mentions []string
+	Cooldown time.Duration
+}
+
+// ParseMentionRule parses a rule written as regexp=@user,@here.
+func ParseMentionRule(s string) (MentionRule, error) {
+	var rule MentionRule
+
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return rule, fmt.Errorf("Missing mentions in %q, expected regexp=@user,@here", s)
+	}
+
+	re, err := regexp.Compile(s[:i])
+	if err != nil {
+		return rule, err
+	}
+	rule.Pattern = re
+
+	for _, mention := range strings.Split(s[i+1:], ",") {
+		mention = strings.TrimSpace(mention)
+		if !strings.HasPrefix(mention, "@") || len(mention) == 1 {
+			return rule, fmt.Errorf("Invalid mention %q in %q", mention, s)
+		}
+		rule.Mentions = append(rule.Mentions, mention)
+	}
+
+	return rule, nil
+}
+
+// mentioner gathers the mentions of the lines of a post.
+type mentioner struct {
+	rules []MentionRule
+	// last time each rule mentioned someone
+	last []time.Time
+
+	mentions []string
+	// first line that triggered the pending mentions
+	line string
+}
+
+func newMentioner(rules []MentionRule) *mentioner {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	return &mentioner{
+		rules: rules,
+		last:  make([]time.Time, len(rules)),
+	}
+}
+
+// match adds the mentions of the rules matching line, unless they're cooling
+// down.
+func (m *mentioner) match(line string) {
+	now := time.Now()
+
+	for i, rule := range m.rules {
+		if !rule.Pattern.MatchString(line) || now.Sub(m.last[i]) < rule.Cooldown {
+			continue
+		}
+		m.last[i] = now
+
+		if len(m.mentions) == 0 {
+			m.line = line
+		}
+		for _, mention := range rule.Mentions {
+			if !contains(m.mentions, mention) {
+				m.mentions = append(m.mentions, mention)
+			}
+		}
+	}
+}
+
+// take returns the pending mentions, and the first line that triggered them.
+func (m *mentioner) take() (string, string) {
+	mentions := strings.Join(m.mentions, " ")
+	line := m.line
+
+	m.mentions = nil
+	m.line = ""
+
+	return mentions, line
+}
+
+func contains(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
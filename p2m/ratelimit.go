@@ -0,0 +1,109 @@
+package p2m
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+// rateLimiter is a token bucket limiting the rate of the requests sent to the
+// server. It can also be paused when the server throttles them.
+type rateLimiter struct {
+	mu sync.Mutex
+
+	// rate is the number of requests per second; 0 means no limit
+	rate  float64
+	burst float64
+
+	tokens float64
+	last   time.Time
+
+	pausedUntil time.Time
+}
+
+// delay returns how long to wait before the next request can be sent.
+func (l *rateLimiter) delay() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.delayLocked(time.Now())
+}
+
+func (l *rateLimiter) delayLocked(now time.Time) time.Duration {
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+	if l.rate == 0 {
+		return 0
+	}
+
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	if l.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// wait blocks until a request can be sent.
+func (l *rateLimiter) wait() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for {
+		d := l.delayLocked(time.Now())
+		if d <= 0 {
+			l.tokens--
+			return
+		}
+
+		l.mu.Unlock()
+		time.Sleep(d)
+		l.mu.Lock()
+	}
+}
+
+// observe pauses the limiter if the server throttled the request or says
+// that no more ones are allowed for now.
+func (l *rateLimiter) observe(resp *model.Response) {
+	var d time.Duration
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		d = headerSeconds(resp.Header, "Retry-After")
+		if d == 0 {
+			d = headerSeconds(resp.Header, "X-Ratelimit-Reset")
+		}
+		if d == 0 {
+			d = time.Second
+		}
+	case resp.Header.Get("X-Ratelimit-Remaining") == "0":
+		d = headerSeconds(resp.Header, "X-Ratelimit-Reset")
+	}
+
+	if d == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until := time.Now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// headerSeconds returns the number of seconds in the given header, or 0 if
+// it's missing or invalid.
+func headerSeconds(h http.Header, name string) time.Duration {
+	n, err := strconv.Atoi(h.Get(name))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
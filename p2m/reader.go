@@ -0,0 +1,258 @@
+package p2m
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// LongLinePolicy tells what to do with lines longer than the maximum line
+// length.
+type LongLinePolicy int
+
+const (
+	// ChunkLongLines splits long lines in multiple ones
+	ChunkLongLines LongLinePolicy = iota
+	// TruncateLongLines drops the end of long lines
+	TruncateLongLines
+	// UploadLongLines uploads long lines as files
+	UploadLongLines
+)
+
+const (
+	// Maximum length of a line when it isn't set.
+	defaultMaxLineLength = 64 * 1024
+
+	// Lines longer than this are truncated even when uploaded.
+	maxUploadSize = 32 * 1024 * 1024
+)
+
+// input is a line read from the input.
+type input struct {
+	text string
+	// huge is set if text is too long to be posted and must be uploaded
+	huge bool
+	// progress is set if text ended with a carriage return: it's redrawn in
+	// place by the next input
+	progress bool
+
+	// number of line feeds read up to the end of text
+	feeds int
+
+	// number of the line in the input and time it was read, set by the
+	// follower
+	num  int
+	time time.Time
+}
+
+// lineReader reads lines of arbitrary length, handling the ones longer than
+// max according to its policy.
+type lineReader struct {
+	max    int
+	policy LongLinePolicy
+	emit   func(input) bool
+
+	line []byte
+	// number of bytes dropped from the current line
+	truncated int
+	// set if a part of the current line has already been emitted
+	chunked bool
+	// last progress line, set until something else is read after it
+	progress *string
+	// number of line feeds read
+	feeds int
+}
+
+// readLines sends the lines read from r on the returned channel, which is
+// closed when r is exhausted or done is closed. The read error, if any, is
+// then available on the second channel. A max of 0 means the default one.
+func readLines(r io.Reader, max int, policy LongLinePolicy, done <-chan struct{}) (<-chan input, <-chan error) {
+	lines := make(chan input)
+	errc := make(chan error, 1)
+
+	if max <= 0 {
+		max = defaultMaxLineLength
+	}
+
+	lr := &lineReader{
+		max:    max,
+		policy: policy,
+		emit: func(in input) bool {
+			select {
+			case lines <- in:
+				return true
+			case <-done:
+				return false
+			}
+		},
+	}
+
+	go func() {
+		defer close(lines)
+		errc <- lr.read(r)
+	}()
+
+	return lines, errc
+}
+
+// read reads r until its end or until emit returns false.
+func (lr *lineReader) read(r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	for {
+		frag, sep, err := scanSegment(br)
+
+		if err == io.EOF {
+			if len(lr.line) > 0 || lr.truncated > 0 {
+				lr.endLine(false)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(frag) > 0 {
+			lr.progress = nil
+		}
+		if !lr.append(frag) {
+			return nil
+		}
+
+		if sep == '\n' {
+			lr.feeds++
+		}
+
+		switch {
+		case sep == '\n' && lr.progress != nil && len(lr.line) == 0:
+			// the line redrawn by the progress lines is complete
+			in := input{text: *lr.progress}
+			lr.progress = nil
+			if !lr.send(in) {
+				return nil
+			}
+		case sep == '\n':
+			if !lr.endLine(false) {
+				return nil
+			}
+		case sep == '\r' && (len(lr.line) > 0 || lr.truncated > 0):
+			if !lr.endLine(true) {
+				return nil
+			}
+		}
+	}
+}
+
+// scanSegment returns the next fragment of the input up to a line feed or a
+// carriage return, along with it. sep is 0 if the fragment doesn't end with
+// either, in which case it's continued by the next one. A carriage return
+// followed by a line feed is returned as a line feed if it's already been
+// read, so that progress lines are sent as soon as possible.
+// The fragment is only valid until the next read.
+func scanSegment(br *bufio.Reader) (frag []byte, sep byte, err error) {
+	if br.Buffered() == 0 {
+		if _, err := br.Peek(1); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	buf, _ := br.Peek(br.Buffered())
+
+	i := bytes.IndexAny(buf, "\r\n")
+	if i < 0 {
+		br.Discard(len(buf))
+		return buf, 0, nil
+	}
+
+	sep = buf[i]
+	br.Discard(i + 1)
+
+	if sep == '\r' && i+1 < len(buf) && buf[i+1] == '\n' {
+		br.Discard(1)
+		sep = '\n'
+	}
+
+	return buf[:i], sep, nil
+}
+
+func (lr *lineReader) append(frag []byte) bool {
+	if lr.truncated > 0 {
+		lr.truncated += len(frag)
+		return true
+	}
+
+	limit := lr.max
+	if lr.policy == UploadLongLines {
+		limit = maxUploadSize
+	}
+
+	lr.line = append(lr.line, frag...)
+
+	for len(lr.line) > limit {
+		n := runeCut(lr.line, limit)
+
+		if lr.policy != ChunkLongLines {
+			lr.truncated = len(lr.line) - n
+			lr.line = lr.line[:n]
+			return true
+		}
+
+		chunk := string(lr.line[:n])
+		lr.line = append(lr.line[:0], lr.line[n:]...)
+		lr.chunked = true
+
+		if !lr.send(input{text: chunk}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (lr *lineReader) endLine(progress bool) bool {
+	in := input{
+		text:     string(lr.line),
+		huge:     !progress && lr.policy == UploadLongLines && len(lr.line) > lr.max,
+		progress: progress,
+	}
+	if lr.truncated > 0 {
+		in.text += fmt.Sprintf(" [%d bytes truncated]", lr.truncated)
+	}
+
+	// the line ended right after its last chunk
+	skip := lr.chunked && len(lr.line) == 0
+
+	lr.line = lr.line[:0]
+	lr.truncated = 0
+	lr.chunked = false
+
+	if progress && !skip {
+		lr.progress = &in.text
+	}
+
+	return skip || lr.send(in)
+}
+
+// send emits in, along with the number of line feeds read so far.
+func (lr *lineReader) send(in input) bool {
+	in.feeds = lr.feeds
+	return lr.emit(in)
+}
+
+// runeCut returns the largest offset lower than or equal to n that doesn't
+// fall in the middle of a rune of b.
+func runeCut(b []byte, n int) int {
+	if n >= len(b) {
+		return len(b)
+	}
+
+	for i := n; i > n-utf8.UTFMax && i > 0; i-- {
+		if utf8.RuneStart(b[i]) {
+			return i
+		}
+	}
+	return n
+}
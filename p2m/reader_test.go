@@ -0,0 +1,94 @@
+package p2m
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadLines(t *testing.T) {
+	tests := []struct {
+		text   string
+		max    int
+		policy LongLinePolicy
+		want   []input
+	}{
+		{"a\nb\n", 0, ChunkLongLines, []input{{text: "a", feeds: 1}, {text: "b", feeds: 2}}},
+		{"a\r\nb", 0, ChunkLongLines, []input{{text: "a", feeds: 1}, {text: "b", feeds: 1}}},
+		{"a\n\nb\n", 0, ChunkLongLines, []input{{text: "a", feeds: 1}, {text: "", feeds: 2}, {text: "b", feeds: 3}}},
+		{
+			"10%\r50%\r100%\ndone\n", 0, ChunkLongLines,
+			[]input{
+				{text: "10%", progress: true},
+				{text: "50%", progress: true},
+				{text: "100%", feeds: 1},
+				{text: "done", feeds: 2},
+			},
+		},
+		{
+			"10%\r100%\r\n", 0, ChunkLongLines,
+			[]input{
+				{text: "10%", progress: true},
+				{text: "100%", feeds: 1},
+			},
+		},
+		{
+			"abcdefghij\nk\n", 4, ChunkLongLines,
+			[]input{{text: "abcd"}, {text: "efgh"}, {text: "ij", feeds: 1}, {text: "k", feeds: 2}},
+		},
+		{
+			"abcdefgh\nk\n", 4, ChunkLongLines,
+			[]input{{text: "abcd"}, {text: "efgh", feeds: 1}, {text: "k", feeds: 2}},
+		},
+		{
+			"ééé\n", 3, ChunkLongLines,
+			[]input{{text: "é"}, {text: "é"}, {text: "é", feeds: 1}},
+		},
+		{
+			"abcdefghij\nk\n", 4, TruncateLongLines,
+			[]input{{text: "abcd [6 bytes truncated]", feeds: 1}, {text: "k", feeds: 2}},
+		},
+		{
+			"abcdefghij\nk\n", 4, UploadLongLines,
+			[]input{{text: "abcdefghij", huge: true, feeds: 1}, {text: "k", feeds: 2}},
+		},
+	}
+
+	for _, test := range tests {
+		lines, errc := readLines(strings.NewReader(test.text), test.max, test.policy, nil)
+
+		var got []input
+		for in := range lines {
+			got = append(got, in)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("readLines(%q) failed: %v", test.text, err)
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("readLines(%q, %d, %d) = %+v, want %+v",
+				test.text, test.max, test.policy, got, test.want)
+		}
+	}
+}
+
+func TestRuneCut(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want int
+	}{
+		{"abc", 2, 2},
+		{"abc", 5, 3},
+		// never 0, so that long lines are always cut somewhere
+		{"é", 1, 1},
+		{"aé", 2, 1},
+		{"aéb", 3, 3},
+	}
+
+	for _, test := range tests {
+		if got := runeCut([]byte(test.s), test.n); got != test.want {
+			t.Errorf("runeCut(%q, %d) = %d, want %d", test.s, test.n, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package p2m
+
+import (
+	"regexp"
+	"strings"
+)
+
+// records joins continuation lines, such as the ones of a stack trace, to the
+// line that started their record.
+type records struct {
+	start *regexp.Regexp
+	lines []input
+}
+
+// add adds in to the current record. If it starts a new one the previous
+// record is returned.
+func (r *records) add(in input) (input, bool) {
+	var rec input
+	var ok bool
+
+	if r.start.MatchString(in.text) {
+		rec, ok = r.take()
+	}
+
+	r.lines = append(r.lines, in)
+	return rec, ok
+}
+
+// take returns the current record, if any, and starts a new one. It has the
+// number and time of its first line.
+func (r *records) take() (input, bool) {
+	if len(r.lines) == 0 {
+		return input{}, false
+	}
+
+	texts := make([]string, len(r.lines))
+	for i, in := range r.lines {
+		texts[i] = in.text
+	}
+
+	rec := r.lines[0]
+	rec.text = strings.Join(texts, "\n")
+	r.lines = nil
+	return rec, true
+}
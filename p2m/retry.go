@@ -0,0 +1,104 @@
+package p2m
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+// RetryPolicy tells how requests that failed because of a transient error
+// are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of a request; 0 or 1
+	// means it's never retried.
+	MaxAttempts int
+	// MaxElapsed is the maximum time spent on a request, including its
+	// retries; 0 means no limit.
+	MaxElapsed time.Duration
+
+	// The delay between two attempts is a random duration between 0 and
+	// BaseDelay, doubled after each attempt up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// Requests that take longer than this fail, so that a connection that hangs
+// counts as a transient error.
+const maxAttemptDuration = 2 * time.Minute
+
+var (
+	jitterMu sync.Mutex
+	jitter   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// backoff returns the delay before the attempt that follows the given number
+// of failed ones.
+func (p RetryPolicy) backoff(failures int) time.Duration {
+	max := p.BaseDelay
+	for i := 1; i < failures && max < p.MaxDelay; i++ {
+		max *= 2
+	}
+	if max > p.MaxDelay {
+		max = p.MaxDelay
+	}
+	if max <= 0 {
+		return 0
+	}
+
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+
+	return time.Duration(jitter.Int63n(int64(max)))
+}
+
+// attemptTimeout returns how long a single attempt of a request may take.
+func (p RetryPolicy) attemptTimeout() time.Duration {
+	if p.MaxElapsed > 0 && p.MaxElapsed < maxAttemptDuration {
+		return p.MaxElapsed
+	}
+	return maxAttemptDuration
+}
+
+// allows reports if a request that failed with resp after the given number
+// of attempts can be retried once elapsed has passed since the first one.
+func (p RetryPolicy) allows(resp *model.Response, attempts int, elapsed time.Duration) bool {
+	if p.MaxElapsed > 0 && elapsed > p.MaxElapsed {
+		return false
+	}
+
+	// throttled requests aren't failures and are retried until the deadline
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+
+	return attempts < p.MaxAttempts && retryable(resp)
+}
+
+// retryable reports if a request that failed with resp may succeed if it's
+// sent again.
+func retryable(resp *model.Response) bool {
+	switch {
+	case resp.StatusCode == 0:
+		// the server couldn't be reached
+		return resp.Error != nil && resp.Error.Id == "model.client.connecting.app_error"
+	case resp.StatusCode == http.StatusRequestTimeout:
+		return true
+	case resp.StatusCode >= 500:
+		return resp.StatusCode != http.StatusNotImplemented
+	}
+	return false
+}
+
+// transientError is returned for requests that failed because of an error
+// that may not occur if they're sent again later.
+type transientError struct {
+	*model.AppError
+}
+
+func isTransient(err error) bool {
+	_, ok := err.(transientError)
+	return ok
+}
@@ -0,0 +1,122 @@
+package p2m
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+func response(status int, errorId string) *model.Response {
+	return &model.Response{
+		StatusCode: status,
+		Error:      model.NewAppError("test", errorId, nil, "", status),
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		resp *model.Response
+		want bool
+	}{
+		{response(0, "model.client.connecting.app_error"), true},
+		{response(0, "model.utils.decode_json.app_error"), false},
+		{response(http.StatusRequestTimeout, "api.context.timeout"), true},
+		{response(http.StatusInternalServerError, "app.error"), true},
+		{response(http.StatusBadGateway, "app.error"), true},
+		{response(http.StatusServiceUnavailable, "app.error"), true},
+		{response(http.StatusNotImplemented, "app.error"), false},
+		{response(http.StatusBadRequest, "app.error"), false},
+		{response(http.StatusUnauthorized, "app.error"), false},
+		{response(http.StatusNotFound, "app.error"), false},
+		{response(http.StatusTooManyRequests, "app.error"), false},
+	}
+
+	for _, test := range tests {
+		if got := retryable(test.resp); got != test.want {
+			t.Errorf("retryable(%d %s) = %v, want %v",
+				test.resp.StatusCode, test.resp.Error.Id, got, test.want)
+		}
+	}
+}
+
+func TestRetryPolicyAllows(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 3, MaxElapsed: time.Minute}
+
+	tests := []struct {
+		status   int
+		attempts int
+		elapsed  time.Duration
+		want     bool
+	}{
+		{http.StatusServiceUnavailable, 1, 0, true},
+		{http.StatusServiceUnavailable, 2, 30 * time.Second, true},
+		{http.StatusServiceUnavailable, 3, 0, false},
+		{http.StatusServiceUnavailable, 1, 2 * time.Minute, false},
+		{http.StatusBadRequest, 1, 0, false},
+		// throttling isn't a failure
+		{http.StatusTooManyRequests, 10, 0, true},
+		{http.StatusTooManyRequests, 1, 2 * time.Minute, false},
+	}
+
+	for _, test := range tests {
+		resp := response(test.status, "app.error")
+		if got := p.allows(resp, test.attempts, test.elapsed); got != test.want {
+			t.Errorf("allows(%d, %d, %s) = %v, want %v",
+				test.status, test.attempts, test.elapsed, got, test.want)
+		}
+	}
+
+	if (RetryPolicy{}).allows(response(http.StatusServiceUnavailable, "app.error"), 1, 0) {
+		t.Error("the zero policy allows retries")
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+
+	tests := []struct {
+		failures int
+		max      time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			if d := p.backoff(test.failures); d < 0 || d >= test.max {
+				t.Errorf("backoff(%d) = %s, want less than %s", test.failures, d, test.max)
+				break
+			}
+		}
+	}
+
+	if d := (RetryPolicy{}).backoff(1); d != 0 {
+		t.Errorf("backoff without delays = %s, want 0", d)
+	}
+}
+
+func TestRetryPolicyAttemptTimeout(t *testing.T) {
+	tests := []struct {
+		maxElapsed time.Duration
+		want       time.Duration
+	}{
+		{0, maxAttemptDuration},
+		{30 * time.Second, 30 * time.Second},
+		{time.Hour, maxAttemptDuration},
+	}
+
+	for _, test := range tests {
+		p := RetryPolicy{MaxElapsed: test.maxElapsed}
+		if got := p.attemptTimeout(); got != test.want {
+			t.Errorf("attemptTimeout with MaxElapsed %s = %s, want %s",
+				test.maxElapsed, got, test.want)
+		}
+	}
+}
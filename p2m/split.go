@@ -0,0 +1,156 @@
+package p2m
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Room kept in each chunk for its continuation marker and the fences closing
+// and reopening a code block.
+const splitReserve = 32
+
+// splitMessage splits msg in chunks of at most max runes, cutting it on line
+// boundaries if possible, then on word boundaries, then between any two
+// runes. A code block spanning several chunks is closed at the end of each
+// one and reopened at the beginning of the next.
+func splitMessage(msg string, max int) []string {
+	if utf8.RuneCountInString(msg) <= max {
+		return []string{msg}
+	}
+
+	var chunks []string
+	var fence string
+
+	for msg != "" {
+		var chunk string
+
+		chunk, msg = cutMessage(msg, max-splitReserve-utf8.RuneCountInString(fence))
+		chunk, fence = balanceFences(chunk, fence)
+		chunks = append(chunks, chunk)
+	}
+
+	if len(chunks) > 1 {
+		for i := range chunks {
+			chunks[i] += fmt.Sprintf("\n(%d/%d)", i+1, len(chunks))
+		}
+	}
+
+	return chunks
+}
+
+// tailMessage returns the end of msg that fits in max runes, starting on a
+// line boundary if possible. The code block it starts in, if any, is
+// reopened.
+func tailMessage(msg string, max int) string {
+	n := utf8.RuneCountInString(msg)
+	if n <= max {
+		return msg
+	}
+
+	start := tailStart(msg, n, max-splitReserve)
+	if fence := openFence(msg[:start]); fence != "" {
+		// the reopened fence line is part of the tail
+		start = tailStart(msg, n, max-splitReserve-utf8.RuneCountInString(fence)-1)
+	}
+
+	head, tail := msg[:start], msg[start:]
+	if fence := openFence(head); fence != "" {
+		tail = fence + "\n" + tail
+	}
+	return tail
+}
+
+// tailStart returns the offset of the last runes of msg, which has n runes,
+// moved to the next line if that doesn't make them too short.
+func tailStart(msg string, n, runes int) int {
+	if runes < 1 {
+		runes = 1
+	}
+
+	start := runeOffset(msg, n-runes)
+	if i := strings.IndexByte(msg[start:], '\n'); i >= 0 && i < (len(msg)-start)/2 {
+		start += i + 1
+	}
+	return start
+}
+
+// cutMessage splits s after at most n runes. It cuts on the last newline or,
+// failing that, the last space if that doesn't make the first part too short.
+func cutMessage(s string, n int) (string, string) {
+	if n < 1 {
+		n = 1
+	}
+	if utf8.RuneCountInString(s) <= n {
+		return s, ""
+	}
+
+	end := runeOffset(s, n)
+
+	for _, sep := range []byte{'\n', ' '} {
+		if i := strings.LastIndexByte(s[:end], sep); i > end/2 {
+			return s[:i], s[i+1:]
+		}
+	}
+	return s[:end], s[end:]
+}
+
+// runeOffset returns the byte offset of the n-th rune of s.
+func runeOffset(s string, n int) int {
+	offset := 0
+	for ; n > 0 && offset < len(s); n-- {
+		_, size := utf8.DecodeRuneInString(s[offset:])
+		offset += size
+	}
+	return offset
+}
+
+// balanceFences reopens the code block started by the fence line at the
+// beginning of msg, if any, and closes the one msg ends in. It returns the
+// resulting message and the line that opened the latter.
+func balanceFences(msg, fence string) (string, string) {
+	if fence != "" {
+		msg = fence + "\n" + msg
+	}
+
+	if fence = openFence(msg); fence != "" {
+		msg += "\n" + fenceMarker(fence)
+	}
+	return msg, fence
+}
+
+// openFence returns the line that opened the code block s ends in, or an
+// empty string if s doesn't end in a code block.
+func openFence(s string) string {
+	var open, marker string
+
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimLeft(line, " ")
+		m := fenceMarker(line)
+		if m == "" {
+			continue
+		}
+
+		if open == "" {
+			open, marker = line, m
+		} else if m[0] == marker[0] && len(m) >= len(marker) && strings.TrimSpace(line[len(m):]) == "" {
+			open, marker = "", ""
+		}
+	}
+
+	return open
+}
+
+// fenceMarker returns the run of backticks or tildes line starts with if it
+// is a code fence, or an empty string otherwise.
+func fenceMarker(line string) string {
+	if !strings.HasPrefix(line, "```") && !strings.HasPrefix(line, "~~~") {
+		return ""
+	}
+
+	n := 3
+	for n < len(line) && line[n] == line[0] {
+		n++
+	}
+	return line[:n]
+}
@@ -0,0 +1,155 @@
+package p2m
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		msg  string
+		max  int
+		want []string
+	}{
+		{"short", 100, []string{"short"}},
+		{
+			strings.Repeat("a", 30) + "\n" + strings.Repeat("b", 30),
+			50,
+			[]string{
+				strings.Repeat("a", 18) + "\n(1/4)",
+				strings.Repeat("a", 12) + "\n(2/4)",
+				strings.Repeat("b", 18) + "\n(3/4)",
+				strings.Repeat("b", 12) + "\n(4/4)",
+			},
+		},
+		{
+			"```go\n" + strings.Repeat("x ", 40) + "\n```",
+			70,
+			[]string{
+				"```go\n" + strings.TrimSpace(strings.Repeat("x ", 16)) + "\n```\n(1/3)",
+				"```go\n" + strings.TrimSpace(strings.Repeat("x ", 16)) + "\n```\n(2/3)",
+				"```go\n" + strings.Repeat("x ", 8) + "\n```\n(3/3)",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got := splitMessage(test.msg, test.max)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitMessage(%q, %d) = %q, want %q", test.msg, test.max, got, test.want)
+		}
+		for _, chunk := range got {
+			if n := utf8.RuneCountInString(chunk); n > test.max {
+				t.Errorf("splitMessage(%q, %d) has a chunk of %d runes", test.msg, test.max, n)
+			}
+		}
+	}
+}
+
+func TestTailMessage(t *testing.T) {
+	longFence := "```" + strings.Repeat("a", 97)
+	lines := strings.TrimSpace(strings.Repeat("line\n", 100))
+
+	tests := []struct {
+		msg  string
+		max  int
+		want string
+	}{
+		{"short", 100, "short"},
+		{"one\ntwo\nthree\nfour", 40, "one\ntwo\nthree\nfour"},
+		{
+			strings.Repeat("a", 40) + "\n" + strings.Repeat("b", 40),
+			60,
+			strings.Repeat("b", 28),
+		},
+		{
+			"```sh\n" + lines,
+			62,
+			"```sh\n" + lines[len(lines)-19:],
+		},
+		{
+			longFence + "\n" + lines,
+			200,
+			longFence + "\n" + lines[len(lines)-64:],
+		},
+	}
+
+	for _, test := range tests {
+		got := tailMessage(test.msg, test.max)
+		if got != test.want {
+			t.Errorf("tailMessage(%q, %d) = %q, want %q", test.msg, test.max, got, test.want)
+		}
+		if n := utf8.RuneCountInString(got); n > test.max {
+			t.Errorf("tailMessage(%q, %d) has %d runes", test.msg, test.max, n)
+		}
+	}
+}
+
+func TestCutMessage(t *testing.T) {
+	tests := []struct {
+		s          string
+		n          int
+		head, tail string
+	}{
+		{"abc", 5, "abc", ""},
+		{"abc def ghi", 9, "abc def", "ghi"},
+		{"abc\ndef ghi", 9, "abc\ndef", "ghi"},
+		{"abcdef\ngh ij", 9, "abcdef", "gh ij"},
+		{"abcdefghi", 4, "abcd", "efghi"},
+		{"a bcdefghi", 6, "a bcde", "fghi"},
+		{"éèàù", 2, "éè", "àù"},
+	}
+
+	for _, test := range tests {
+		head, tail := cutMessage(test.s, test.n)
+		if head != test.head || tail != test.tail {
+			t.Errorf("cutMessage(%q, %d) = %q, %q, want %q, %q",
+				test.s, test.n, head, tail, test.head, test.tail)
+		}
+	}
+}
+
+func TestBalanceFences(t *testing.T) {
+	tests := []struct {
+		msg, fence string
+		want       string
+		wantFence  string
+	}{
+		{"text", "", "text", ""},
+		{"```go\ncode", "", "```go\ncode\n```", "```go"},
+		{"more code", "```go", "```go\nmore code\n```", "```go"},
+		{"end\n```\ntext", "```go", "```go\nend\n```\ntext", ""},
+		{"````\n```\nstill code", "", "````\n```\nstill code\n````", "````"},
+		{"~~~\ncode", "", "~~~\ncode\n~~~", "~~~"},
+	}
+
+	for _, test := range tests {
+		got, fence := balanceFences(test.msg, test.fence)
+		if got != test.want || fence != test.wantFence {
+			t.Errorf("balanceFences(%q, %q) = %q, %q, want %q, %q",
+				test.msg, test.fence, got, fence, test.want, test.wantFence)
+		}
+	}
+}
+
+func TestFenceMarker(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"```", "```"},
+		{"```go", "```"},
+		{"`````", "`````"},
+		{"~~~~ text", "~~~~"},
+		{"``", ""},
+		{"text", ""},
+	}
+
+	for _, test := range tests {
+		if got := fenceMarker(test.line); got != test.want {
+			t.Errorf("fenceMarker(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package p2m
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/platform/model"
+)
+
+const (
+	// The spool is drained at this interval while following a stream.
+	spoolDrainInterval = 30 * time.Second
+	// Messages are sent at most this often to check if the server is back
+	// before being spooled.
+	spoolProbeInterval = time.Second
+)
+
+// Spool is a directory where messages that couldn't be sent because the
+// server is unreachable are saved until they can be.
+type Spool struct {
+	dir string
+
+	mu    sync.Mutex
+	seq   int
+	count int
+	// ids of the posts created for each stream while draining
+	posts map[string]string
+
+	// held while draining, so that messages aren't sent twice
+	draining chan struct{}
+}
+
+// spooled is a message saved in a spool.
+type spooled struct {
+	ChannelId string    `json:"channel_id"`
+	RootId    string    `json:"root_id,omitempty"`
+	Message   string    `json:"message"`
+	Time      time.Time `json:"time"`
+
+	Filename string `json:"filename,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+
+	Attachment *model.SlackAttachment `json:"attachment,omitempty"`
+
+	// Stream identifies the follower that spooled the message, so that the
+	// messages of a thread are replayed in it, and the states of an updated
+	// message update the same post, even if it wasn't created yet when
+	// they were spooled.
+	Stream string `json:"stream,omitempty"`
+	Thread bool   `json:"thread,omitempty"`
+	// Update is set for a new state of the post PostId, or of the stream's
+	// post if it's empty.
+	Update bool   `json:"update,omitempty"`
+	PostId string `json:"post_id,omitempty"`
+}
+
+// OpenSpool opens the spool in the given directory, creating it if needed.
+func OpenSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		dir:      dir,
+		posts:    make(map[string]string),
+		draining: make(chan struct{}, 1),
+	}
+
+	names, err := s.names()
+	if err != nil {
+		return nil, err
+	}
+	s.count = len(names)
+
+	return s, nil
+}
+
+// Len returns the number of messages in the spool.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.count
+}
+
+// add adds a message to the spool and returns the name of its file.
+func (s *Spool) add(m spooled) (string, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// names sort in the order messages were added, even across runs
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), s.seq)
+
+	// the message is written in a temporary file first so that it's
+	// never read half-written
+	tmp := filepath.Join(s.dir, name+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		return "", err
+	}
+
+	s.count++
+	return name, nil
+}
+
+// names returns the names of the spooled messages' files, oldest first.
+func (s *Spool) names() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".json") {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (s *Spool) read(name string) (spooled, error) {
+	var m spooled
+
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+	if err == nil {
+		err = json.Unmarshal(data, &m)
+	}
+	return m, err
+}
+
+// remove removes a message from the spool. If failed is set its file is kept
+// under another name for inspection. Messages that were already removed are
+// ignored.
+func (s *Spool) remove(name string, failed bool) error {
+	path := filepath.Join(s.dir, name)
+
+	var err error
+	if failed {
+		err = os.Rename(path, path+".failed")
+	} else {
+		err = os.Remove(path)
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.count--
+	s.mu.Unlock()
+
+	return nil
+}
+
+// DrainSpool sends the messages of the spool in the order they were added,
+// removing them once they're sent. It stops at the first one that can't be
+// sent because of a transient error. Messages that can't be sent because of
+// another error are set aside.
+func (c *Client) DrainSpool(s *Spool) error {
+	s.draining <- struct{}{}
+	defer func() { <-s.draining }()
+
+	return c.drainSpool(s)
+}
+
+// tryDrainSpool drains the spool like DrainSpool, unless it's already being
+// drained. It returns false in that case.
+func (c *Client) tryDrainSpool(s *Spool) (bool, error) {
+	select {
+	case s.draining <- struct{}{}:
+	default:
+		return false, nil
+	}
+	defer func() { <-s.draining }()
+
+	return true, c.drainSpool(s)
+}
+
+func (c *Client) drainSpool(s *Spool) error {
+	names, err := s.names()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		m, err := s.read(name)
+		if os.IsNotExist(err) {
+			// replaced by a newer state of the same post
+			continue
+		}
+		if err == nil {
+			err = c.sendSpooled(s, m)
+		}
+
+		if isTransient(err) {
+			return err
+		}
+		if err := s.remove(name, err != nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) sendSpooled(s *Spool, m spooled) error {
+	if m.Update {
+		return c.sendSpooledUpdate(s, m)
+	}
+
+	msg := fmt.Sprintf("_Delayed message from %s:_\n%s",
+		m.Time.Format("2006-01-02 15:04:05 MST"), m.Message)
+
+	rootId := m.RootId
+	if rootId == "" && m.Thread {
+		rootId = s.post(m.Stream)
+	}
+
+	var postId string
+	var err error
+
+	if m.Attachment != nil {
+		postId, err = c.PostAttachment(msg, m.Attachment, m.ChannelId, rootId)
+	} else if m.Data != nil {
+		postId, err = c.PostFile(msg, m.ChannelId, rootId, m.Filename, m.Data)
+	} else if m.Thread {
+		postId, _, err = c.Reply(msg, m.ChannelId, rootId)
+	} else {
+		_, err = c.Post(msg, m.ChannelId)
+	}
+
+	if err == nil && m.Thread && rootId == "" {
+		// the message started the thread
+		s.setPost(m.Stream, postId)
+	}
+	return err
+}
+
+// sendSpooledUpdate sends a spooled state of an updated message. It isn't
+// marked as delayed since it's replaced by the following ones.
+func (c *Client) sendSpooledUpdate(s *Spool, m spooled) error {
+	postId := m.PostId
+	if postId == "" {
+		postId = s.post(m.Stream)
+	}
+
+	if postId != "" {
+		_, err := c.Update(postId, m.Message)
+		return err
+	}
+
+	var err error
+	if m.Thread {
+		_, postId, err = c.Reply(m.Message, m.ChannelId, m.RootId)
+	} else {
+		postId, err = c.Post(m.Message, m.ChannelId)
+	}
+	if err == nil {
+		s.setPost(m.Stream, postId)
+	}
+	return err
+}
+
+// post returns the id of the post created for stream while draining, if
+// any: the root of its thread, or the post it updates.
+func (s *Spool) post(stream string) string {
+	if stream == "" {
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.posts[stream]
+}
+
+func (s *Spool) setPost(stream, postId string) {
+	if stream == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.posts[stream] = postId
+}
+
+// spooling reports if messages must be spooled to be sent after the ones
+// that already are.
+func (f *follower) spooling() bool {
+	return f.opts.Spool != nil && f.opts.Spool.Len() > 0
+}
+
+// deliver sends a message through send, or spools it if the spool isn't
+// empty or if it can't be sent because the server is unreachable.
+func (f *follower) deliver(m spooled, send func() error) error {
+	if f.spooling() && !f.drainInline() {
+		return f.spool(m)
+	}
+	f.adoptSpooledPosts()
+
+	err := send()
+	if f.opts.Spool != nil && isTransient(err) {
+		return f.spool(m)
+	}
+	return err
+}
+
+func (f *follower) spool(m spooled) error {
+	m.ChannelId = f.channelId
+	m.RootId = f.rootId
+	m.Stream = f.stream
+	m.Thread = f.opts.Thread
+	if m.Update {
+		m.PostId = f.postId
+	}
+	m.Time = time.Now()
+
+	name, err := f.opts.Spool.add(m)
+	if err != nil {
+		return err
+	}
+
+	if m.Update {
+		// only the latest state of the message is worth sending
+		if f.spooledUpdate != "" {
+			if err := f.opts.Spool.remove(f.spooledUpdate, false); err != nil {
+				return err
+			}
+		}
+		f.spooledUpdate = name
+	}
+	return nil
+}
+
+// drainInline tries to drain the spool without waiting for the server or for
+// the background drain, so that messages stop being spooled as soon as it's
+// back. It reports if the spool is empty.
+func (f *follower) drainInline() bool {
+	if time.Since(f.drainProbed) < spoolProbeInterval {
+		return false
+	}
+	f.drainProbed = time.Now()
+
+	// a single attempt per message, the spool keeps the ones that failed
+	c := *f.c
+	c.retry = RetryPolicy{MaxAttempts: 1, MaxElapsed: time.Nanosecond}
+
+	if ok, _ := c.tryDrainSpool(f.opts.Spool); !ok {
+		return false
+	}
+	return !f.spooling()
+}
+
+// adoptSpooledPosts picks the thread root or the updated post that were
+// created while draining the spool, if the follower didn't know them yet.
+func (f *follower) adoptSpooledPosts() {
+	if f.opts.Spool == nil {
+		return
+	}
+
+	if f.opts.Thread && f.rootId == "" {
+		f.rootId = f.opts.Spool.post(f.stream)
+	}
+	if f.opts.Update && f.postId == "" {
+		f.postId = f.opts.Spool.post(f.stream)
+	}
+}
+
+// drainInBackground periodically drains the spool until the returned
+// function is called.
+func (f *follower) drainInBackground() func() {
+	quit := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(spoolDrainInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if f.opts.Spool.Len() > 0 {
+					f.c.DrainSpool(f.opts.Spool)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			close(quit)
+			<-finished
+		})
+	}
+}
+
+// drainSpool sends the spooled messages at the end of the stream.
+func (f *follower) drainSpool() error {
+	if f.opts.Spool == nil {
+		return nil
+	}
+
+	f.stopDraining()
+
+	if err := f.c.DrainSpool(f.opts.Spool); err != nil {
+		return fmt.Errorf("%d messages left in the spool: %v", f.opts.Spool.Len(), err)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package p2m
+
+import (
+	"encoding/csv"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// table renders lines of CSV, TSV or aligned columns as the rows of a
+// markdown table, the first one being its header.
+type table struct {
+	format InputFormat
+
+	// header line as read, and as a markdown table header
+	line    string
+	header  string
+	columns int
+	// offsets of the columns in runes, with ColumnsFormat
+	starts []int
+}
+
+// add adds a line of the table. It returns the markdown row to post, or false
+// if there's none.
+func (t *table) add(line string) (string, bool) {
+	if strings.TrimSpace(line) == "" || line == t.line {
+		// e.g. the header printed again by watch-like tools
+		return "", false
+	}
+
+	if t.line == "" {
+		t.line = line
+		if t.format == ColumnsFormat {
+			t.starts = columnStarts(line)
+		}
+
+		cells := t.cells(line)
+		t.columns = len(cells)
+
+		seps := make([]string, len(cells))
+		for i := range seps {
+			seps[i] = "---"
+		}
+		t.header = markdownRow(cells) + "\n" + markdownRow(seps)
+		return "", false
+	}
+
+	cells := t.cells(line)
+	for len(cells) < t.columns {
+		cells = append(cells, "")
+	}
+	return markdownRow(cells), true
+}
+
+// cells returns the cells of line.
+func (t *table) cells(line string) []string {
+	switch t.format {
+	case CSVFormat:
+		r := csv.NewReader(strings.NewReader(line))
+		r.LazyQuotes = true
+		r.FieldsPerRecord = -1
+		if cells, err := r.Read(); err == nil {
+			return cells
+		}
+		return []string{line}
+	case TSVFormat:
+		return strings.Split(line, "\t")
+	}
+
+	return cutColumns(line, t.starts)
+}
+
+// columnStarts returns the offsets of the columns of header, which are
+// separated by at least two spaces or a tab.
+func columnStarts(header string) []int {
+	var starts []int
+	var spaces int
+
+	for i, r := range []rune(header) {
+		switch {
+		case r == '\t':
+			spaces += 2
+		case r == ' ':
+			spaces++
+		default:
+			if len(starts) == 0 || spaces >= 2 {
+				starts = append(starts, i)
+			}
+			spaces = 0
+		}
+	}
+	return starts
+}
+
+// Separators of the columns of a header, which values normally don't contain.
+var columnSeparator = regexp.MustCompile(`\s{2,}|\t`)
+
+// cutColumns cuts line at the given offsets. When a value is wider than its
+// column or spans several of them, the rest of the line is split on
+// whitespace if that gives the number of remaining columns. Otherwise the
+// value pushes the following cut to its end.
+func cutColumns(line string, starts []int) []string {
+	runes := []rune(line)
+
+	var cells []string
+	from := 0
+
+	for i := 1; i <= len(starts); i++ {
+		to := len(runes)
+		overflow := false
+		if i < len(starts) && starts[i] < len(runes) {
+			to = starts[i]
+			for to < len(runes) && to > from && !unicode.IsSpace(runes[to-1]) && !unicode.IsSpace(runes[to]) {
+				to++
+				overflow = true
+			}
+		}
+		if to < from {
+			// the previous value overflowed past this column
+			to = from
+		}
+
+		cell := strings.TrimSpace(string(runes[from:to]))
+		if overflow || columnSeparator.MatchString(cell) {
+			if rest, ok := splitColumns(string(runes[from:]), len(starts)-i+1); ok {
+				return append(cells, rest...)
+			}
+		}
+
+		cells = append(cells, cell)
+		from = to
+	}
+
+	return cells
+}
+
+// splitColumns splits s in n values separated by whitespace, preferring the
+// separators of column headers so that values can contain single spaces.
+func splitColumns(s string, n int) ([]string, bool) {
+	s = strings.TrimSpace(s)
+
+	if values := columnSeparator.Split(s, -1); len(values) == n {
+		return values, true
+	}
+	if values := strings.Fields(s); len(values) == n {
+		return values, true
+	}
+	return nil, false
+}
+
+// markdownRow returns cells as a row of a markdown table.
+func markdownRow(cells []string) string {
+	escaped := make([]string, len(cells))
+	for i, cell := range cells {
+		escaped[i] = strings.Replace(cell, "|", `\|`, -1)
+	}
+	return "| " + strings.Join(escaped, " | ") + " |"
+}
+
+// headerRunes returns the size of the header, including the newline
+// separating it from the rows.
+func (t *table) headerRunes() int {
+	return utf8.RuneCountInString(t.header) + 1
+}
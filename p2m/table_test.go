@@ -0,0 +1,74 @@
+package p2m
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestColumnStarts(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []int
+	}{
+		{"NAME  READY  STATUS", []int{0, 6, 13}},
+		{"NAME\tREADY\tSTATUS", []int{0, 5, 11}},
+		{"  NAME   AGE", []int{2, 9}},
+		{"CONTAINER ID   IMAGE", []int{0, 15}},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		if got := columnStarts(test.header); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("columnStarts(%q) = %v, want %v", test.header, got, test.want)
+		}
+	}
+}
+
+func TestCutColumns(t *testing.T) {
+	header := "NAME      READY   STATUS    RESTARTS   AGE"
+	starts := columnStarts(header)
+
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{
+			"web-1     1/1     Running   0          5m",
+			[]string{"web-1", "1/1", "Running", "0", "5m"},
+		},
+		{
+			"web-1     1/1     Running",
+			[]string{"web-1", "1/1", "Running", "", ""},
+		},
+		{
+			"web-1     1/1     Running   0          5d12h",
+			[]string{"web-1", "1/1", "Running", "0", "5d12h"},
+		},
+		{
+			"web-1     1/1     CrashLoopBackOff   3          5m",
+			[]string{"web-1", "1/1", "CrashLoopBackOff", "3", "5m"},
+		},
+		{
+			"very-long-pod-name-that-overflows-col 0/1 CrashLoopBackOff 12 1h",
+			[]string{"very-long-pod-name-that-overflows-col", "0/1", "CrashLoopBackOff", "12", "1h"},
+		},
+		{
+			"web-1   0/1   Pending   0     0s",
+			[]string{"web-1", "0/1", "Pending", "0", "0s"},
+		},
+		{
+			"web-1     1/1     Running   0          5m   extra",
+			[]string{"web-1", "1/1", "Running", "0", "5m   extra"},
+		},
+		{
+			"",
+			[]string{"", "", "", "", ""},
+		},
+	}
+
+	for _, test := range tests {
+		if got := cutColumns(test.line, starts); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("cutColumns(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package p2m
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Maximum size of the input buffered by an asyncTee.
+const teeBufferSize = 16 * 1024 * 1024
+
+// asyncTee reads r in the background and writes what it reads to w right
+// away. It's buffered in memory until it's read from the asyncTee, so that
+// its slow readers don't stall w. Once teeBufferSize bytes are buffered r
+// isn't read anymore until they catch up: stalling w is preferred to using
+// unbounded memory or losing part of the input.
+type asyncTee struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	buf bytes.Buffer
+	// err is set to the read error, or io.EOF, once r is exhausted
+	err error
+}
+
+func newAsyncTee(r io.Reader, w io.Writer) io.Reader {
+	t := &asyncTee{}
+	t.cond = sync.NewCond(&t.mu)
+
+	go t.copy(r, w)
+
+	return t
+}
+
+func (t *asyncTee) copy(r io.Reader, w io.Writer) {
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, err := r.Read(buf)
+
+		if n > 0 {
+			// a failing writer doesn't prevent the input to be posted
+			if w != nil {
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					w = nil
+				}
+			}
+
+			t.mu.Lock()
+			for t.buf.Len() >= teeBufferSize {
+				t.cond.Wait()
+			}
+			t.buf.Write(buf[:n])
+			t.cond.Broadcast()
+			t.mu.Unlock()
+		}
+
+		if err != nil {
+			t.mu.Lock()
+			t.err = err
+			t.cond.Broadcast()
+			t.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (t *asyncTee) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for t.buf.Len() == 0 && t.err == nil {
+		t.cond.Wait()
+	}
+
+	if t.buf.Len() > 0 {
+		n, err := t.buf.Read(p)
+		t.cond.Broadcast()
+		return n, err
+	}
+	return 0, t.err
+}
@@ -0,0 +1,164 @@
+package p2m
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// Emojis of the levels and of the values meaning success, for the emoji
+// template function.
+var (
+	levelEmojis = map[Level]string{
+		InfoLevel:    ":information_source:",
+		WarningLevel: ":warning:",
+		ErrorLevel:   ":red_circle:",
+	}
+	successEmoji = ":white_check_mark:"
+	successNames = []string{"ok", "success", "succeeded", "passed", "done"}
+)
+
+// Characters escaped by the escape template function.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `{`, `\{`, `}`, `\}`,
+	`[`, `\[`, `]`, `\]`, `(`, `\(`, `)`, `\)`, `#`, `\#`, `+`, `\+`,
+	`-`, `\-`, `.`, `\.`, `!`, `\!`, `|`, `\|`, `~`, `\~`, `>`, `\>`,
+	`<`, `\<`,
+)
+
+var templateFuncs = template.FuncMap{
+	"truncate": truncate,
+	"escape":   escape,
+	"code":     templateCode,
+	"emoji":    emoji,
+}
+
+// templateLine is a line given to message templates.
+type templateLine struct {
+	Line string
+	// Num is the number of the line in the input
+	Num  int
+	Time time.Time
+	// Fields are the fields of the line if it's a JSON object
+	Fields map[string]interface{}
+}
+
+// templateData is given to message templates. Line, Num, Time and Fields are
+// the ones of the first line of the message, except that Line is the text of
+// all its lines.
+type templateData struct {
+	templateLine
+	Host  string
+	Lines []templateLine
+}
+
+// lineMeta is what's known about a line of a batch besides its text.
+type lineMeta struct {
+	num  int
+	time time.Time
+}
+
+// ParseTemplate parses a template rendering messages, with its helper
+// functions.
+func ParseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+// executeTemplate renders lines with t.
+func executeTemplate(t *template.Template, lines []string, meta []lineMeta) (string, error) {
+	var data templateData
+
+	data.Host, _ = os.Hostname()
+
+	for i, line := range lines {
+		tl := templateLine{
+			Line:   line,
+			Fields: parseFields(line),
+		}
+		if i < len(meta) {
+			tl.Num = meta[i].num
+			tl.Time = meta[i].time
+		}
+		data.Lines = append(data.Lines, tl)
+	}
+
+	if len(data.Lines) > 0 {
+		data.templateLine = data.Lines[0]
+		data.Line = strings.Join(lines, "\n")
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// parseFields returns the fields of line if it's a JSON object, nil
+// otherwise.
+func parseFields(line string) map[string]interface{} {
+	if !strings.HasPrefix(strings.TrimSpace(line), "{") {
+		return nil
+	}
+
+	var fields map[string]interface{}
+
+	d := json.NewDecoder(strings.NewReader(line))
+	d.UseNumber()
+	if err := d.Decode(&fields); err != nil {
+		return nil
+	}
+	return fields
+}
+
+// templateString returns a value given to a template function as text, nil
+// being empty so that missing fields don't fail the template.
+func templateString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return formatValue(v)
+}
+
+// truncate cuts v after n characters.
+func truncate(n int, v interface{}) string {
+	s := templateString(v)
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return s[:runeOffset(s, n)] + "…"
+}
+
+// escape escapes the markdown of v.
+func escape(v interface{}) string {
+	return markdownEscaper.Replace(templateString(v))
+}
+
+// templateCode wraps its last argument in a code block, with its first one as
+// the language hint if there are two, as in {{.Line | code "json"}}.
+func templateCode(args ...interface{}) (string, error) {
+	switch len(args) {
+	case 1:
+		return codeBlock(templateString(args[0]), ""), nil
+	case 2:
+		return codeBlock(templateString(args[1]), templateString(args[0])), nil
+	}
+	return "", errors.New("code takes a text and an optional language")
+}
+
+// emoji returns the emoji of a level, or of a value meaning success.
+func emoji(v interface{}) string {
+	if s, ok := v.(string); ok {
+		for _, name := range successNames {
+			if strings.EqualFold(s, name) {
+				return successEmoji
+			}
+		}
+	}
+	return levelEmojis[parseLevel(v)]
+}
@@ -0,0 +1,68 @@
+package p2m
+
+import (
+	"os"
+	"testing"
+)
+
+func TestExecuteTemplate(t *testing.T) {
+	host, _ := os.Hostname()
+
+	// the example of the README
+	tmpl, err := ParseTemplate("message",
+		"{{emoji .Fields.level}} **{{.Host}}** {{.Fields.msg | escape | truncate 300}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		line string
+		want string
+	}{
+		{
+			`{"level":"error","msg":"disk *full*"}`,
+			":red_circle: **" + host + "** disk \\*full\\*",
+		},
+		{
+			`{"msg":42}`,
+			":information_source: **" + host + "** 42",
+		},
+		{
+			"plain text line",
+			":information_source: **" + host + "** ",
+		},
+	}
+
+	for _, test := range tests {
+		got, err := executeTemplate(tmpl, []string{test.line}, nil)
+		if err != nil {
+			t.Errorf("executeTemplate(%q) failed: %v", test.line, err)
+		} else if got != test.want {
+			t.Errorf("executeTemplate(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{`{{.Fields.missing | truncate 3}}`, ""},
+		{`{{.Line | truncate 3}}`, "{\"a…"},
+		{`{{.Fields.a | code "json"}}`, "```json\n[1,2]\n```"},
+	}
+
+	for _, test := range tests {
+		tmpl, err := ParseTemplate("test", test.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := executeTemplate(tmpl, []string{`{"a":[1,2]}`}, nil)
+		if err != nil {
+			t.Errorf("%s failed: %v", test.text, err)
+		} else if got != test.want {
+			t.Errorf("%s = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package p2m
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// window keeps the last lines of a stream. Lines that scroll out of it are
+// appended to archive if it's not nil.
+type window struct {
+	lines []string
+	runes int
+
+	maxLines int
+	maxRunes int
+
+	// fence is the line opening the code block the window starts in, if any
+	fence string
+
+	archive *archive
+}
+
+func (w *window) add(line string) {
+	w.lines = append(w.lines, line)
+	w.runes += utf8.RuneCountInString(line) + 1
+
+	for len(w.lines) > 1 && w.overflows() {
+		old := w.lines[0]
+		w.lines = w.lines[1:]
+		w.runes -= utf8.RuneCountInString(old) + 1
+
+		_, w.fence = balanceFences(old, w.fence)
+
+		if w.archive != nil {
+			w.archive.add(old)
+		}
+	}
+}
+
+func (w *window) overflows() bool {
+	return (w.maxLines > 0 && len(w.lines) > w.maxLines) ||
+		(w.maxRunes > 0 && w.runes-1 > w.maxRunes)
+}
+
+func (w *window) String() string {
+	return strings.Join(w.lines, "\n")
+}
+
+// archive keeps lines in a temporary file until they're uploaded.
+type archive struct {
+	f    *os.File
+	size int64
+	// number of parts taken
+	parts int
+	// first error writing the file
+	err error
+}
+
+func (a *archive) add(line string) {
+	if a.err != nil {
+		return
+	}
+
+	if a.f == nil {
+		a.f, a.err = ioutil.TempFile("", "pipe2mattermost-archive-")
+		if a.err != nil {
+			return
+		}
+	}
+
+	n, err := io.WriteString(a.f, line+"\n")
+	a.size += int64(n)
+	a.err = err
+}
+
+// take returns the archived lines and empties the archive.
+func (a *archive) take() ([]byte, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+
+	data := make([]byte, a.size)
+	if _, err := a.f.ReadAt(data, 0); err != nil {
+		return nil, err
+	}
+	if err := a.f.Truncate(0); err != nil {
+		return nil, err
+	}
+	if _, err := a.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	a.size = 0
+	a.parts++
+	return data, nil
+}
+
+// close removes the temporary file.
+func (a *archive) close() {
+	if a.f != nil {
+		a.f.Close()
+		os.Remove(a.f.Name())
+	}
+}
@@ -1,21 +1,108 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"regexp"
+	"time"
 
 	"github.com/oscaro/pipe2mattermost/p2m"
 )
 
 func main() {
 	var team string
-	var update bool
+	var recordStart string
+	var longLines string
+	var rate float64
+	var burst int
+	var retry p2m.RetryPolicy
+	var spoolDir string
+	var shutdownTimeout time.Duration
+	var tee bool
+	var teeFile string
+	var stderrPrefix string
+	var report string
+	var lockFile string
+	var timeout time.Duration
+	var killGrace time.Duration
+	var ansi string
+	var levels bool
+	var mentionCooldown time.Duration
+	var format string
+	var messageKeys, fieldKeys string
+	var tmpl, tmplFile string
+	var files []string
+	var stateFile string
+	var errorPattern, warningPattern, infoPattern string
+	var opts p2m.FollowOptions
 
-	flag.BoolVar(&update, "update", false, "Continuously update the same message")
+	flag.BoolVar(&opts.Update, "update", false, "Continuously update the same message")
 	flag.StringVar(&team, "team", "", "Team name")
+	flag.DurationVar(&opts.BatchInterval, "batch-interval", 0, "Gather lines read during this interval in a single message")
+	flag.IntVar(&opts.BatchLines, "batch-lines", 0, "Gather up to this many lines in a single message")
+	flag.Var(codeFlag{&opts}, "code", "Wrap messages in code blocks, with an optional language hint (-code=json)")
+	flag.IntVar(&opts.TailLines, "tail", 0, "With -update, only show the last lines read")
+	flag.IntVar(&opts.TailRunes, "tail-runes", 0, "With -update, only show the last characters read")
+	flag.BoolVar(&opts.Archive, "archive", false, "With -tail, upload the lines that scrolled out as a file at the end")
+	flag.BoolVar(&opts.Thread, "thread", false, "Post the first message as a thread and the following ones as replies")
+	flag.BoolVar(&opts.ThreadSummary, "thread-summary", false, "With -thread, add the number of lines and the duration to the thread's root at the end")
+	flag.StringVar(&recordStart, "record-start", "", "Join lines that don't match this regexp to the previous one, e.g. for stack traces")
+	flag.DurationVar(&opts.RecordTimeout, "record-timeout", 2*time.Second, "With -record-start, send the current record if no line was read during this time")
+	flag.Var(regexpsFlag{&opts.Include}, "include", "Only post the lines matching this regexp (can be repeated)")
+	flag.Var(regexpsFlag{&opts.Exclude}, "exclude", "Don't post the lines matching this regexp (can be repeated)")
+	flag.BoolVar(&opts.Invert, "invert", false, "Post the lines not selected by -include and -exclude instead")
+	flag.BoolVar(&opts.SkipBlank, "skip-blank", false, "Don't post blank lines")
+	flag.IntVar(&opts.Context, "context", 0, "With -include or -exclude, also post this many lines before and after each selected one")
+	flag.BoolVar(&levels, "levels", false, "Post warnings and errors as colored attachments")
+	flag.StringVar(&errorPattern, "error-pattern", `(?i)\b(?:error|err|fatal|crit(?:ical)?|alert|emerg(?:ency)?|panic|severe)\b`, "With -levels, regexp matching error lines")
+	flag.StringVar(&warningPattern, "warning-pattern", `(?i)\b(?:warn(?:ing)?)\b`, "With -levels, regexp matching warning lines")
+	flag.StringVar(&infoPattern, "info-pattern", `(?i)\b(?:info|notice|debug|trace)\b`, "With -levels, regexp matching info lines")
+	flag.StringVar(&format, "format", "plain", "Format of the input: plain, json for one JSON object per line, or csv, tsv or columns for a table")
+	flag.StringVar(&messageKeys, "message-key", "msg,message", "With -format=json, comma-separated keys of the message of each object, the first one found is used")
+	flag.StringVar(&opts.LevelKey, "level-key", "level", "With -format=json, key of the level of each object, which drives its color")
+	flag.StringVar(&fieldKeys, "fields", "", "With -format=json, comma-separated keys shown as fields below the message")
+	flag.StringVar(&tmpl, "template", "", "Go template rendering each message, e.g. '{{.Time.Format \"15:04\"}} {{.Line | truncate 200}}'")
+	flag.StringVar(&tmplFile, "template-file", "", "Read the -template from this file")
+	flag.BoolVar(&opts.Dedup, "dedup", false, "Collapse consecutive identical lines into a \"last message repeated N times\" line")
+	flag.BoolVar(&opts.DedupNormalize, "dedup-normalize", false, "With -dedup, ignore numbers and UUIDs when comparing lines")
+	flag.DurationVar(&opts.DedupInterval, "dedup-interval", time.Minute, "With -dedup, post the number of repetitions of a line at least this often while it's repeated")
+	flag.Var(mentionsFlag{&opts.Mentions}, "mention", "Mention people in the posts of the lines matching a regexp, as in regexp=@user,@here (can be repeated)")
+	flag.DurationVar(&mentionCooldown, "mention-cooldown", 10*time.Minute, "With -mention, minimum interval between mentions of the same rule")
+	flag.StringVar(&ansi, "ansi", "keep", "What to do with ANSI escape sequences (colors, cursor moves): keep, strip or markdown")
+	flag.DurationVar(&opts.ProgressInterval, "progress-interval", time.Second, "With -update, minimum interval between updates of lines redrawn with carriage returns, like progress bars")
+	flag.IntVar(&opts.MaxLineLength, "max-line", 64*1024, "Maximum length of a line, in bytes")
+	flag.StringVar(&longLines, "long-lines", "chunk", "What to do with lines longer than -max-line: chunk, truncate or upload")
+	flag.Float64Var(&rate, "rate", 0, "Maximum number of messages sent per second (0 for no limit)")
+	flag.IntVar(&burst, "burst", 5, "With -rate, number of messages that can be sent at once")
+	flag.IntVar(&retry.MaxAttempts, "retries", 5, "Maximum number of attempts to send a message when the server fails")
+	flag.DurationVar(&retry.MaxElapsed, "retry-timeout", 10*time.Minute, "Maximum time spent trying to send a message")
+	flag.StringVar(&spoolDir, "spool", "", "Save the messages that can't be sent in this directory until they can")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "Maximum time spent sending pending messages when interrupted")
+	flag.StringVar(&opts.InterruptNotice, "interrupt-notice", "", "Message posted when interrupted by a signal")
+	flag.Var(stringsFlag{&files}, "file", "Follow this file instead of reading stdin, through truncation and rotation; it can be a glob and be repeated")
+	flag.StringVar(&stateFile, "state-file", "", "With -file, save the read offsets in this file to resume from them after a restart")
+	flag.BoolVar(&tee, "tee", false, "Copy the input to stdout")
+	flag.StringVar(&teeFile, "tee-file", "", "Copy the input to this file")
+	flag.StringVar(&stderrPrefix, "stderr-prefix", "[stderr] ", "With run or cron, prefix of the lines the command writes on stderr")
+	flag.StringVar(&report, "report", "", "With run or cron, when to post the command's output: always, output or failure (default always with run, failure with cron)")
+	flag.StringVar(&lockFile, "lock", "", "With run or cron, don't run the command if another process holds a lock on this file")
+	flag.DurationVar(&timeout, "timeout", 0, "With run or cron, stop the command if it runs for longer than this")
+	flag.DurationVar(&killGrace, "kill-grace", 10*time.Second, "With -timeout, kill the command if it's still running this long after being asked to terminate")
 
-	flag.Parse()
+	// pipe2mattermost flush -spool <dir> <server URL>
+	// pipe2mattermost run <server URL> <channel> -- <command> [args...]
+	// pipe2mattermost cron <server URL> <channel> -- <command> [args...]
+	var command string
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == "flush" || args[0] == "run" || args[0] == "cron") {
+		command, args = args[0], args[1:]
+	}
+
+	flag.CommandLine.Parse(args)
 
 	// echo foo | pipe2mattermost <server URL> <channel>
 	serverURL := flag.Arg(0)
@@ -24,22 +111,251 @@ func main() {
 	if serverURL == "" {
 		log.Fatal("I need a server URL")
 	}
-	if channelSlug == "" {
+	if channelSlug == "" && command != "flush" {
 		log.Fatal("I need a channel slug")
 	}
 
+	var argv []string
+	if command == "run" || command == "cron" {
+		argv = flag.Args()[2:]
+		if len(argv) > 0 && argv[0] == "--" {
+			argv = argv[1:]
+		}
+		if len(argv) == 0 {
+			log.Fatal("I need a command to run")
+		}
+	}
+	if spoolDir == "" && command == "flush" {
+		log.Fatal("I need a spool directory")
+	}
+	if opts.Update && opts.Thread {
+		log.Fatal("-update and -thread can't be used together")
+	}
+	if opts.Update && levels {
+		log.Fatal("-update and -levels can't be used together")
+	}
+	switch format {
+	case "plain":
+		opts.Format = p2m.PlainFormat
+	case "json":
+		opts.Format = p2m.JSONFormat
+	case "csv":
+		opts.Format = p2m.CSVFormat
+	case "tsv":
+		opts.Format = p2m.TSVFormat
+	case "columns":
+		opts.Format = p2m.ColumnsFormat
+	default:
+		log.Fatalf("Unknown -format: %s", format)
+	}
+	if opts.Update && opts.Format == p2m.JSONFormat {
+		log.Fatal("-update and -format=json can't be used together")
+	}
+	opts.MessageKeys = splitList(messageKeys)
+	opts.FieldKeys = splitList(fieldKeys)
+	switch longLines {
+	case "chunk":
+		opts.LongLines = p2m.ChunkLongLines
+	case "truncate":
+		opts.LongLines = p2m.TruncateLongLines
+	case "upload":
+		opts.LongLines = p2m.UploadLongLines
+	default:
+		log.Fatalf("Unknown -long-lines policy: %s", longLines)
+	}
+	switch ansi {
+	case "keep":
+		opts.ANSI = p2m.KeepANSI
+	case "strip":
+		opts.ANSI = p2m.StripANSI
+	case "markdown":
+		opts.ANSI = p2m.MarkdownANSI
+	default:
+		log.Fatalf("Unknown -ansi mode: %s", ansi)
+	}
+	if opts.Context < 0 {
+		log.Fatal("-context can't be negative")
+	}
+	if opts.MaxLineLength <= 0 {
+		log.Fatal("-max-line must be positive")
+	}
+
+	runOpts := p2m.RunOptions{
+		StderrPrefix: stderrPrefix,
+		LockFile:     lockFile,
+		Timeout:      timeout,
+		KillGrace:    killGrace,
+	}
+	if report == "" && command == "cron" {
+		report = "failure"
+	}
+	switch report {
+	case "", "always":
+		runOpts.Report = p2m.ReportAlways
+	case "output":
+		runOpts.Report = p2m.ReportOutput
+	case "failure":
+		runOpts.Report = p2m.ReportFailure
+	default:
+		log.Fatalf("Unknown -report policy: %s", report)
+	}
+
+	if len(files) > 0 && command != "" {
+		log.Fatalf("-file can't be used with %s", command)
+	}
+	if stateFile != "" && len(files) == 0 {
+		log.Fatal("-state-file needs -file")
+	}
+
+	if tee && teeFile != "" {
+		log.Fatal("-tee and -tee-file can't be used together")
+	}
+
+	if opts.Invert && len(opts.Include) == 0 && len(opts.Exclude) == 0 {
+		log.Fatal("-invert needs -include or -exclude")
+	}
+
+	if recordStart != "" {
+		re, err := regexp.Compile(recordStart)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.RecordStart = re
+	}
+
+	if levels {
+		opts.Levels = p2m.LevelPatterns{}
+		patterns := map[p2m.Level]string{
+			p2m.ErrorLevel:   errorPattern,
+			p2m.WarningLevel: warningPattern,
+			p2m.InfoLevel:    infoPattern,
+		}
+		for level, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				log.Fatal(err)
+			}
+			opts.Levels[level] = re
+		}
+	}
+
+	if tmpl != "" && tmplFile != "" {
+		log.Fatal("-template and -template-file can't be used together")
+	}
+	if tmplFile != "" {
+		b, err := ioutil.ReadFile(tmplFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tmpl = string(b)
+	}
+	if tmpl != "" {
+		t, err := p2m.ParseTemplate("message", tmpl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Template = t
+	}
+
+	for i := range opts.Mentions {
+		opts.Mentions[i].Cooldown = mentionCooldown
+	}
+
 	c := p2m.MakeClient(serverURL)
+	c.SetRateLimit(rate, burst)
+
+	retry.BaseDelay = time.Second
+	retry.MaxDelay = time.Minute
+	c.SetRetryPolicy(retry)
+
 	if err := c.Login(); err != nil {
 		log.Fatal(err)
 	}
 
+	if spoolDir != "" {
+		spool, err := p2m.OpenSpool(spoolDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Spool = spool
+	}
+
+	if command == "flush" {
+		if err := c.DrainSpool(opts.Spool); err != nil {
+			log.Fatalf("%d messages left in the spool: %v", opts.Spool.Len(), err)
+		}
+		return
+	}
+
 	channelId, err := c.GetChannelId(channelSlug, team)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err := c.Follow(os.Stdin, channelId, update); err != nil {
+	if tee {
+		opts.Tee = os.Stdout
+	} else if teeFile != "" {
+		f, err := os.Create(teeFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		opts.Tee = f
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	flush := make(chan struct{}, 1)
+	opts.Flush = flush
+
+	handleSignals(cancel, flush, shutdownTimeout)
+
+	if argv != nil {
+		runOpts.Follow = opts
+
+		code, err := c.Run(ctx, channelId, argv, runOpts)
+		if err == p2m.ErrSkipped {
+			log.Print(err)
+			os.Exit(75) // EX_TEMPFAIL
+		}
+		if err != nil && err != context.Canceled {
+			log.Fatal(err)
+		}
+		if code < 0 {
+			code = 1
+		}
+		os.Exit(code)
+	}
+
+	var input io.Reader = os.Stdin
+	var tail *p2m.TailReader
+
+	if len(files) > 0 {
+		tail, err = p2m.TailFiles(ctx, files, stateFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		input = tail
+
+		// the files stop being read when interrupted, then the lines read
+		// are sent before saving their offsets
+		opts.Drain = true
+		opts.Checkpoint = tail.Checkpoint
+	}
+
+	err = c.Follow(ctx, input, channelId, opts)
+	if err != nil && err != context.Canceled {
 		log.Fatal(err)
 	}
+
+	if tail != nil {
+		if err := tail.SaveState(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err == context.Canceled {
+		log.Fatal("Interrupted")
+	}
 }
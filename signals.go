@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// handleSignals calls cancel on SIGINT or SIGTERM, then exits if the shutdown
+// takes longer than timeout or if another one is received. It sends on flush
+// when one of flushSignals is received.
+func handleSignals(cancel func(), flush chan<- struct{}, timeout time.Duration) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	force := make(chan os.Signal, 1)
+	if len(flushSignals) > 0 {
+		signal.Notify(force, flushSignals...)
+	}
+
+	go func() {
+		stopping := false
+
+		for {
+			select {
+			case sig := <-stop:
+				if stopping {
+					log.Fatalf("Received %s again, exiting", sig)
+				}
+				stopping = true
+
+				log.Printf("Received %s, sending pending messages", sig)
+				cancel()
+
+				time.AfterFunc(timeout, func() {
+					log.Fatal("Couldn't send pending messages in time, exiting")
+				})
+
+			case <-force:
+				select {
+				case flush <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+}
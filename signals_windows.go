@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// there's no SIGUSR1 on Windows
+var flushSignals []os.Signal